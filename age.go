@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// The config file and key files can be encrypted with age
+// (https://age-encryption.org), so that they can be kept in git along
+// with everything else. They are decrypted at startup, with the
+// identities (private keys) given to flux-recv; those can be mounted
+// from a secret that is managed separately.
+//
+// Files encrypted with SOPS aren't decrypted; encrypt the whole file
+// with age instead.
+
+const ageIntro = "age-encryption.org/v1\n"
+
+// ageIdentities are the identities used to decrypt files; they're
+// loaded at startup from the files given with --age-identity.
+var ageIdentities []age.Identity
+
+// parseAgeIdentities parses identities in the format written by
+// age-keygen: one `AGE-SECRET-KEY-1...` per line, with comments.
+func parseAgeIdentities(b []byte) ([]age.Identity, error) {
+	return age.ParseIdentities(bytes.NewReader(b))
+}
+
+// isAgeEncrypted reports whether the bytes look like an age file,
+// binary or armored.
+func isAgeEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(ageIntro)) || bytes.HasPrefix(bytes.TrimSpace(b), []byte(armor.Header))
+}
+
+// ageDecrypt decrypts an age file, binary or armored, with one of the
+// identities given.
+func ageDecrypt(b []byte, ids []age.Identity) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(b)
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(armor.Header)) {
+		r = armor.NewReader(bytes.NewReader(bytes.TrimSpace(b)))
+	}
+	plain, err := age.Decrypt(r, ids...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(plain)
+}
+
+// loadAgeIdentities loads the identity files given, adding to
+// ageIdentities.
+func loadAgeIdentities(paths []string) error {
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		ids, err := parseAgeIdentities(b)
+		if err != nil {
+			return fmt.Errorf("cannot load age identities from %s: %s", path, err.Error())
+		}
+		ageIdentities = append(ageIdentities, ids...)
+	}
+	return nil
+}
+
+// readSecretFile reads a file, decrypting it if it's encrypted with
+// age.
+func readSecretFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isAgeEncrypted(b) {
+		return b, nil
+	}
+	if len(ageIdentities) == 0 {
+		return nil, fmt.Errorf("%s is encrypted, but no age identities were supplied (use --age-identity)", path)
+	}
+	plain, err := ageDecrypt(b, ageIdentities)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt %s: %s", path, err.Error())
+	}
+	return plain, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+func withAgeIdentity(t *testing.T, path string) func() {
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	ids, err := parseAgeIdentities(b)
+	assert.NoError(t, err)
+	saved := ageIdentities
+	ageIdentities = ids
+	return func() { ageIdentities = saved }
+}
+
+// The fixtures were encrypted with the age command-line tool, to the
+// identity in test/fixtures/age_identity.
+func TestAgeDecrypt(t *testing.T) {
+	defer withAgeIdentity(t, "test/fixtures/age_identity")()
+
+	// binary, encrypted to two recipients
+	key, err := loadKey("test/fixtures", Endpoint{KeyPath: "github_key.age"})
+	assert.NoError(t, err)
+	assert.Equal(t, string(loadFixture(t, "github_key")), string(key))
+
+	// armored
+	token, err := readSecretFile("test/fixtures/token.age")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t\n", string(token))
+
+	config, err := ConfigFromFile("test/fixtures/fluxrecv.yaml.age")
+	assert.NoError(t, err)
+	assert.Len(t, config.Endpoints, 1)
+	assert.Equal(t, "github_key.age", config.Endpoints[0].KeyPath)
+
+	// files that aren't encrypted are read as they are
+	plain, err := readSecretFile("test/fixtures/github_key")
+	assert.NoError(t, err)
+	assert.Equal(t, string(loadFixture(t, "github_key")), string(plain))
+}
+
+func TestAgeDecryptFails(t *testing.T) {
+	_, err := readSecretFile("test/fixtures/token.age")
+	assert.Error(t, err, "no identities")
+
+	defer withAgeIdentity(t, "test/fixtures/age_identity")()
+
+	// an identity that token.age isn't encrypted to (though
+	// github_key.age is)
+	other, err := parseAgeIdentities([]byte("AGE-SECRET-KEY-1XFXDT0F4ZFLTGE8C260WM87JNYJT23P98ZW2MJXR9MX8M505HAVQF4MNPK\n"))
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile(filepath.Join("test/fixtures", "token.age"))
+	assert.NoError(t, err)
+	_, err = ageDecrypt(b, other)
+	_, noMatch := err.(*age.NoIdentityMatchError)
+	assert.True(t, noMatch, "expected no matching identity, got %v", err)
+	b, err = ioutil.ReadFile(filepath.Join("test/fixtures", "github_key.age"))
+	assert.NoError(t, err)
+	_, err = ageDecrypt(b, other)
+	assert.NoError(t, err)
+
+	// tampering with the payload
+	tampered := append([]byte{}, b...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = ageDecrypt(tampered, ageIdentities)
+	assert.Error(t, err)
+
+	_, err = parseAgeIdentities([]byte("AGE-SECRET-KEY-1NOTAKEY\n"))
+	assert.Error(t, err)
+}
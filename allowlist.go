@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Some providers publish the addresses from which they send webhooks,
+// which means an endpoint can refuse requests from anywhere else.
+// This is the only protection available for sources that can't sign
+// their payloads (e.g., DockerHub and Quay), but it's a good idea for
+// any of them.
+
+type rangesPreset struct {
+	url    string
+	parse  func([]byte) ([]string, error)
+	static []string
+}
+
+var ipRangePresets = map[string]rangesPreset{
+	// https://docs.github.com/en/rest/meta
+	GitHub: {url: "https://api.github.com/meta", parse: parseGitHubMeta},
+	// https://support.atlassian.com/organization-administration/docs/ip-addresses-and-domains-for-atlassian-cloud-products/
+	BitbucketCloud: {url: "https://ip-ranges.atlassian.com/", parse: parseAtlassianRanges},
+	// GitLab.com doesn't publish these in a machine-readable form;
+	// https://docs.gitlab.com/ee/user/gitlab_com/#ip-range
+	GitLab: {static: []string{"34.74.90.64/28", "34.74.226.0/24"}},
+}
+
+const (
+	defaultRangesRefresh = time.Hour
+	rangesRetry          = time.Minute
+	rangesHTTPTimeout    = 30 * time.Second
+)
+
+var rangesClient = &http.Client{Timeout: rangesHTTPTimeout}
+
+func parseGitHubMeta(b []byte) ([]string, error) {
+	var meta struct {
+		Hooks []string `json:"hooks"`
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return meta.Hooks, nil
+}
+
+func parseAtlassianRanges(b []byte) ([]string, error) {
+	var ranges struct {
+		Items []struct {
+			CIDR      string   `json:"cidr"`
+			Product   []string `json:"product"`
+			Direction []string `json:"direction"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(b, &ranges); err != nil {
+		return nil, err
+	}
+	var cidrs []string
+	for _, item := range ranges.Items {
+		// Older versions of the file don't say which product or
+		// direction a range is for; in that case, include it.
+		if len(item.Product) > 0 && !hasString(item.Product, "bitbucket") {
+			continue
+		}
+		if len(item.Direction) > 0 && !hasString(item.Direction, "egress") {
+			continue
+		}
+		cidrs = append(cidrs, item.CIDR)
+	}
+	return cidrs, nil
+}
+
+// parseCIDRLines parses a plain list of addresses, one per line, with
+// blank lines and comments (starting with `#`) ignored.
+func parseCIDRLines(b []byte) ([]string, error) {
+	var cidrs []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			cidrs = append(cidrs, line)
+		}
+	}
+	return cidrs, scanner.Err()
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowList is the runtime form of IPAllowList.
+type ipAllowList struct {
+	url      string
+	parse    func([]byte) ([]string, error)
+	interval time.Duration
+
+	mu          sync.Mutex
+	static      []*net.IPNet
+	loaded      []*net.IPNet
+	nextRefresh time.Time
+	refreshing  bool
+}
+
+func newIPAllowList(baseDir string, conf IPAllowList) (*ipAllowList, error) {
+	list := &ipAllowList{
+		url:      conf.URL,
+		parse:    parseCIDRLines,
+		interval: time.Duration(conf.RefreshInterval),
+	}
+	if list.interval <= 0 {
+		list.interval = defaultRangesRefresh
+	}
+
+	cidrs := conf.CIDRs
+	if conf.Preset != "" {
+		preset, ok := ipRangePresets[conf.Preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown IP range preset %q", conf.Preset)
+		}
+		cidrs = append(cidrs, preset.static...)
+		if preset.parse != nil {
+			list.parse = preset.parse
+		}
+		// if there's a file, presumably it's to be used _instead_
+		// of fetching from the provider
+		if list.url == "" && conf.File == "" {
+			list.url = preset.url
+		}
+	}
+
+	if conf.File != "" {
+		bytes, err := ioutil.ReadFile(filepath.Join(baseDir, conf.File))
+		if err != nil {
+			return nil, fmt.Errorf("cannot load IP ranges from %q: %s", conf.File, err.Error())
+		}
+		fromFile, err := list.parse(bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse IP ranges in %q: %s", conf.File, err.Error())
+		}
+		cidrs = append(cidrs, fromFile...)
+	}
+
+	static, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	list.static = static
+
+	if list.url == "" && len(static) == 0 {
+		return nil, fmt.Errorf("IP allow list is empty; give cidrs, a preset, a file, or a URL")
+	}
+	if list.url != "" {
+		// A failure here is not fatal, since it may be a passing
+		// problem; it'll be retried, and until then only the static
+		// ranges are allowed.
+		if err := list.refresh(); err != nil {
+			log("could not fetch IP ranges from", list.url, ":", err.Error())
+		}
+	}
+	return list, nil
+}
+
+func (l *ipAllowList) refresh() error {
+	cidrs, err := l.fetch()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refreshing = false
+	if err != nil {
+		l.nextRefresh = time.Now().Add(rangesRetry)
+		return err
+	}
+	l.loaded = cidrs
+	l.nextRefresh = time.Now().Add(l.interval)
+	return nil
+}
+
+func (l *ipAllowList) fetch() ([]*net.IPNet, error) {
+	resp, err := rangesClient.Get(l.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	cidrs, err := l.parse(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no IP ranges found")
+	}
+	return parseCIDRs(cidrs)
+}
+
+// allows reports whether the IP given is in the list. If the ranges
+// fetched from a URL are due a refresh, it starts one in the
+// background.
+func (l *ipAllowList) allows(ip net.IP) bool {
+	l.mu.Lock()
+	if l.url != "" && !l.refreshing && time.Now().After(l.nextRefresh) {
+		l.refreshing = true
+		go func() {
+			if err := l.refresh(); err != nil {
+				log("could not refresh IP ranges from", l.url, ":", err.Error())
+			}
+		}()
+	}
+	static, loaded := l.static, l.loaded
+	l.mu.Unlock()
+
+	if ip == nil {
+		return false
+	}
+	return containsIP(static, ip) || containsIP(loaded, ip)
+}
+
+func (l *ipAllowList) wrap(source string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r); !l.allows(ip) {
+			http.Error(w, "Requests are not accepted from this address", http.StatusForbidden)
+			log(source, "request from address not in allow list:", ip.String())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseCIDRs([]string{"10.0.0.0/8", "192.168.1.1"})
+	assert.NoError(t, err)
+
+	for _, tt := range []struct {
+		desc     string
+		remote   string
+		headers  map[string]string
+		expected string
+	}{
+		{
+			desc:     "direct",
+			remote:   "203.0.113.7:5555",
+			expected: "203.0.113.7",
+		},
+		{
+			desc:     "untrusted remote cannot claim to forward",
+			remote:   "203.0.113.7:5555",
+			headers:  map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expected: "203.0.113.7",
+		},
+		{
+			desc:     "trusted proxy",
+			remote:   "10.1.2.3:5555",
+			headers:  map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expected: "198.51.100.1",
+		},
+		{
+			desc:     "spoofed hop left of the client is ignored",
+			remote:   "10.1.2.3:5555",
+			headers:  map[string]string{"X-Forwarded-For": "140.82.112.1, 198.51.100.1, 192.168.1.1"},
+			expected: "198.51.100.1",
+		},
+		{
+			desc:     "Forwarded is preferred",
+			remote:   "10.1.2.3:5555",
+			headers:  map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https`, "X-Forwarded-For": "198.51.100.1"},
+			expected: "2001:db8:cafe::17",
+		},
+		{
+			desc:    "obfuscated node",
+			remote:  "10.1.2.3:5555",
+			headers: map[string]string{"Forwarded": "for=_hidden"},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hook/foo", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			ip := trustedProxies(proxies).clientIP(req)
+			if tt.expected == "" {
+				assert.Nil(t, ip)
+			} else {
+				assert.Equal(t, tt.expected, ip.String())
+			}
+		})
+	}
+}
+
+func Test_AllowedIPs(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedDockerhub, &called)
+	defer downstream.Close()
+
+	meta := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"hooks": ["192.0.2.0/24"], "git": ["203.0.113.0/24"]}`)
+	}))
+	defer meta.Close()
+
+	endpoint := Endpoint{
+		Source:  DockerHub,
+		KeyPath: "dockerhub_key",
+		AllowedIPs: &IPAllowList{
+			Preset: GitHub,
+			URL:    meta.URL,
+			CIDRs:  []string{"198.51.100.7"},
+		},
+	}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
+	assert.NoError(t, err)
+	proxies, _ := parseCIDRs([]string{"10.0.0.0/8"})
+	handler = withClientIP(proxies, handler)
+
+	for _, tt := range []struct {
+		client string
+		status int
+	}{
+		{"192.0.2.44", http.StatusOK},
+		{"198.51.100.7", http.StatusOK},
+		{"203.0.113.9", http.StatusForbidden},
+		{"198.51.100.8", http.StatusForbidden},
+	} {
+		t.Run(tt.client, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "dockerhub_payload")))
+			req.RemoteAddr = "10.0.0.1:4567"
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Forwarded-For", tt.client)
+			rec := httptest.NewRecorder()
+
+			called = false
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, tt.status == http.StatusOK, called)
+		})
+	}
+}
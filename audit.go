@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The audit log has a line of JSON for each delivery (see
+// delivery.go), so it's possible to find out later who triggered what.
+// It's rotated when it gets too big: the current file is renamed with
+// the suffix `.1`, the previous `.1` to `.2`, and so on, up to the
+// number of backups kept.
+
+const (
+	defaultAuditMaxBytes   = 100 << 20
+	defaultAuditMaxBackups = 5
+	// means write to stdout, e.g., to be collected with the container
+	// logs
+	auditStdout = "-"
+)
+
+type auditLog struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mu   sync.Mutex
+	out  io.Writer
+	file *os.File
+	size int64
+}
+
+func openAuditLog(baseDir string, conf AuditLog) (*auditLog, error) {
+	if conf.Path == "" {
+		return nil, fmt.Errorf("auditLog: path must be given")
+	}
+	if conf.MaxBytes < 0 || conf.MaxBackups < 0 {
+		return nil, fmt.Errorf("auditLog: maxBytes and maxBackups must not be negative")
+	}
+	a := &auditLog{
+		path:       conf.Path,
+		maxBytes:   conf.MaxBytes,
+		maxBackups: conf.MaxBackups,
+	}
+	if a.maxBytes == 0 {
+		a.maxBytes = defaultAuditMaxBytes
+	}
+	if a.maxBackups == 0 {
+		a.maxBackups = defaultAuditMaxBackups
+	}
+
+	if a.path == auditStdout {
+		a.out = os.Stdout
+		return a, nil
+	}
+	if !filepath.IsAbs(a.path) {
+		a.path = filepath.Join(baseDir, a.path)
+	}
+	if err := a.open(); err != nil {
+		return nil, fmt.Errorf("auditLog: %s", err.Error())
+	}
+	return a, nil
+}
+
+// open opens the file for appending, and notes how big it is already.
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.out, a.size = f, f, info.Size()
+	return nil
+}
+
+// rotate moves the current file and its backups along one, dropping
+// the oldest, and starts a new file. If the files can't be moved, it
+// carries on with the current file. Call with the lock held.
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	a.file, a.out = nil, nil
+	if err := a.shiftBackups(); err != nil {
+		if openErr := a.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return a.open()
+}
+
+func (a *auditLog) shiftBackups() error {
+	for i := a.maxBackups - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", a.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", a.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(a.path, a.path+".1")
+}
+
+// write appends the delivery record to the log. Failing to write is
+// logged, rather than failing the request.
+func (a *auditLog) write(d *delivery) {
+	d.mu.Lock()
+	line, err := json.Marshal(d)
+	d.mu.Unlock()
+	if err != nil {
+		log("could not encode audit record:", err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.path != auditStdout && a.size > 0 && a.size+int64(len(line)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			log("could not rotate audit log:", err.Error())
+		}
+	}
+	if a.out == nil {
+		if err := a.open(); err != nil {
+			log("could not open audit log:", err.Error())
+			return
+		}
+	}
+	n, err := a.out.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log("could not write to audit log:", err.Error())
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the record as it is in the log, for checking
+type auditRecord struct {
+	Endpoint     string
+	Source       string
+	ClientIP     string
+	DeliveryID   string
+	Verification string
+	Status       int
+	Changes      []struct {
+		Change struct {
+			Kind   string
+			Source map[string]interface{}
+		}
+		Result  string
+		Error   string
+		Targets []targetResult
+	}
+	BodySHA256 string
+	BodyBytes  int64
+}
+
+func readAuditLog(t *testing.T, path string) []auditRecord {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec auditRecord
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+	return records
+}
+
+func Test_AuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var called bool
+	downstream := newDownstream(t, expectedGithub, &called)
+	defer downstream.Close()
+
+	audit, err := openAuditLog(dir, AuditLog{Path: "audit.log"})
+	assert.NoError(t, err)
+
+	endpoint := Endpoint{Name: "app", Source: GitHub, KeyPath: "github_key"}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint, WithAuditLog(audit))
+	assert.NoError(t, err)
+
+	payload := loadFixture(t, "github_payload")
+	send := func(signature string) {
+		req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(payload))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		req.Header.Set("X-Hub-Signature", signature)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send(xHubSignature(payload, loadFixture(t, "github_key")))
+	send("sha1=forged")
+	assert.True(t, called)
+
+	records := readAuditLog(t, filepath.Join(dir, "audit.log"))
+	if !assert.Len(t, records, 2) {
+		return
+	}
+	sum := sha256.Sum256(payload)
+
+	ok := records[0]
+	assert.Equal(t, "app", ok.Endpoint)
+	assert.Equal(t, GitHub, ok.Source)
+	assert.Equal(t, "192.0.2.1", ok.ClientIP)
+	assert.Equal(t, "72d3162e-cc78-11e3-81ab-4c9367dc0958", ok.DeliveryID)
+	assert.Equal(t, verificationVerified, ok.Verification)
+	assert.Equal(t, http.StatusOK, ok.Status)
+	assert.Equal(t, hex.EncodeToString(sum[:]), ok.BodySHA256)
+	assert.Equal(t, int64(len(payload)), ok.BodyBytes)
+	if assert.Len(t, ok.Changes, 1) {
+		assert.Equal(t, "git", ok.Changes[0].Change.Kind)
+		assert.Equal(t, "git@github.com:Codertocat/Hello-World.git", ok.Changes[0].Change.Source["URL"])
+		assert.Equal(t, resultOK, ok.Changes[0].Result)
+	}
+
+	forged := records[1]
+	assert.Equal(t, verificationFailed, forged.Verification)
+	assert.Equal(t, http.StatusUnauthorized, forged.Status)
+	assert.Empty(t, forged.Changes)
+	assert.Equal(t, hex.EncodeToString(sum[:]), forged.BodySHA256)
+}
+
+func Test_AuditLogVerification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	audit, err := openAuditLog(dir, AuditLog{Path: "audit.log"})
+	assert.NoError(t, err)
+
+	// DockerHub has nothing to verify; and a request refused by the
+	// guard doesn't get as far as the handler
+	endpoint := Endpoint{Source: DockerHub, KeyPath: "dockerhub_key"}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: "http://127.0.0.1:1"}, endpoint, WithAuditLog(audit))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "dockerhub_payload")))
+	req.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("GET", "/hook/foo", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	records := readAuditLog(t, filepath.Join(dir, "audit.log"))
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, verificationNone, records[0].Verification)
+		assert.NotEmpty(t, records[0].DeliveryID)
+		if assert.Len(t, records[0].Changes, 1) {
+			assert.Equal(t, resultError, records[0].Changes[0].Result)
+			assert.NotEmpty(t, records[0].Changes[0].Error)
+		}
+		assert.Equal(t, verificationRefused, records[1].Verification)
+		assert.Equal(t, http.StatusMethodNotAllowed, records[1].Status)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	audit, err := openAuditLog(dir, AuditLog{Path: "audit.log", MaxBytes: 300, MaxBackups: 2})
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		audit.write(&delivery{DeliveryID: "0123456789abcdef0123456789abcdef"})
+	}
+
+	path := filepath.Join(dir, "audit.log")
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if assert.NoError(t, err) {
+			assert.True(t, info.Size() <= 300)
+		}
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Requests for hooks that don't exist are recorded, but only so many,
+// and without reading their bodies.
+func TestAuditLogUnknownHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	audit, err := openAuditLog(dir, AuditLog{Path: "audit.log"})
+	assert.NoError(t, err)
+	handler := trackUnknownHooks(audit)
+
+	for i := 0; i < 3*unknownHookRecordBurst; i++ {
+		req := httptest.NewRequest("POST", "/hook/nonesuch", bytes.NewReader(loadFixture(t, "github_payload")))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	}
+
+	records := readAuditLog(t, filepath.Join(dir, "audit.log"))
+	// one more may have been allowed, if the loop was slow
+	assert.True(t, len(records) >= unknownHookRecordBurst && len(records) <= unknownHookRecordBurst+1, len(records))
+	for _, rec := range records {
+		assert.Equal(t, verificationRefused, rec.Verification)
+		assert.Equal(t, http.StatusNotFound, rec.Status)
+		assert.Empty(t, rec.BodySHA256)
+		assert.Zero(t, rec.BodyBytes)
+	}
+}
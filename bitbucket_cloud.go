@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"net/http"
 
-	fluxapi "github.com/fluxcd/flux/pkg/api"
 	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
 )
 
@@ -25,14 +24,16 @@ const BitbucketCloud = "BitbucketCloud"
 
 func init() {
 	Sources[BitbucketCloud] = handleBitbucketCloudPush
+	deliveryIDHeaders[BitbucketCloud] = "X-Request-UUID"
 }
 
-func handleBitbucketCloudPush(s fluxapi.Server, _ []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
+func handleBitbucketCloudPush(s Notifier, _ []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
 	if event := r.Header.Get("X-Event-Key"); event != "repo:push" {
 		http.Error(w, "Unexpected or missing header X-Event-Key", http.StatusBadRequest)
 		log(BitbucketCloud, "missing or incorrect X-Event-Key header:", event)
 		return
 	}
+	setEvent(r.Context(), "repo:push")
 
 	type bitbucketCloudPayload struct {
 		Repository bitbucketCloudRepository
@@ -54,35 +55,29 @@ func handleBitbucketCloudPush(s fluxapi.Server, _ []byte, w http.ResponseWriter,
 
 	// The bitbucket.org events potentially contain many ref updates;
 	// presumably, it bundles together e.g., the result of a `git
-	// push` into one event. We only notify about one things at a time
-	// though, so:
-	//  - collect all the changes
-	//  - send as many as we can before we reach our deadline.
-	// That may mean we miss some, but this is best effort.
+	// push` into one event. We only notify about one thing at a time
+	// though, so each change is sent on, and the response says what
+	// came of each.
 	//
 	// NB a change can be to a branch or a tag; here we'll send both
 	// through, since it's in principle possible to sync to a tag.
 
 	repo := payload.Repository.RepoURL()
-	ctx, cancel := context.WithTimeout(r.Context(), timeout)
-	defer cancel()
+	var changes []fluxapi_v9.Change
 	for i := range payload.Push.Changes {
 		refChange := payload.Push.Changes[i].New
-		change := fluxapi_v9.Change{
+		changes = append(changes, fluxapi_v9.Change{
 			Kind: fluxapi_v9.GitChange,
 			Source: fluxapi_v9.GitUpdate{
 				URL:    repo,
 				Branch: refChange.Name,
 			},
-		}
-		if err := s.NotifyChange(ctx, change); err != nil {
-			http.Error(w, "Unable to process all push events", http.StatusInternalServerError)
-			log(BitbucketCloud, "error from downstream:", err.Error())
-			return
-		}
+		})
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	outcomes, err := notifyChanges(ctx, s, changes)
+	respondChanges(w, r, BitbucketCloud, outcomes, err)
 }
 
 // The fields of repository that we care about
@@ -3,23 +3,21 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strings"
 
-	fluxapi "github.com/fluxcd/flux/pkg/api"
 	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
 	"github.com/google/go-github/v28/github"
-	"golang.org/x/sync/errgroup"
 )
 
 const BitbucketServer = "BitbucketServer"
 
 func init() {
 	Sources[BitbucketServer] = handleBitbucketServerPush
+	deliveryIDHeaders[BitbucketServer] = "X-Request-Id"
 }
 
-func handleBitbucketServerPush(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
+func handleBitbucketServerPush(s Notifier, key []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
 	// See incomplete docs: https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html
 
 	body, err := github.ValidatePayload(r, key)
@@ -28,11 +26,13 @@ func handleBitbucketServerPush(s fluxapi.Server, key []byte, w http.ResponseWrit
 		log(BitbucketServer, "invalid signature:", err.Error())
 		return
 	}
+	markVerified(r)
 	if eventKey := r.Header.Get("X-Event-Key"); eventKey != "repo:refs_changed" {
 		http.Error(w, "Unexpected or missing header X-Event-Key", http.StatusBadRequest)
 		log(BitbucketServer, "unexpected X-Event-Key header:", eventKey)
 		return
 	}
+	setEvent(r.Context(), "repo:refs_changed")
 	var event bitbucketRefsChangedEvent
 	if err := json.Unmarshal(body, &event); err != nil {
 		http.Error(w, "Unable to JSON decode payload", http.StatusBadRequest)
@@ -46,28 +46,20 @@ func handleBitbucketServerPush(s fluxapi.Server, key []byte, w http.ResponseWrit
 		return
 	}
 
-	var grp errgroup.Group
-	ctx, cancel := context.WithTimeout(r.Context(), timeout)
-	defer cancel()
-	for refID := range event.changeRefIDs("BRANCH") {
-		branch := strings.TrimPrefix(refID, "refs/heads/")
-		grp.Go(func() error {
-			return s.NotifyChange(ctx, fluxapi_v9.Change{
-				Kind: fluxapi_v9.GitChange,
-				Source: fluxapi_v9.GitUpdate{
-					URL:    repoURL,
-					Branch: branch,
-				},
-			})
+	var changes []fluxapi_v9.Change
+	for _, refID := range event.changeRefIDs("BRANCH") {
+		changes = append(changes, fluxapi_v9.Change{
+			Kind: fluxapi_v9.GitChange,
+			Source: fluxapi_v9.GitUpdate{
+				URL:    repoURL,
+				Branch: strings.TrimPrefix(refID, "refs/heads/"),
+			},
 		})
 	}
-	if err := grp.Wait(); err != nil {
-		http.Error(w, "Unable to process all push events", http.StatusInternalServerError)
-		log(BitbucketServer, "error from downstream:", err.Error())
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "OK")
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	outcomes, err := notifyChanges(ctx, s, changes)
+	respondChanges(w, r, BitbucketServer, outcomes, err)
 }
 
 type bitbucketRefsChangedEvent struct {
@@ -96,16 +88,17 @@ func (e *bitbucketRefsChangedEvent) repoCloneLink(name string) (string, bool) {
 	return "", false
 }
 
-func (e *bitbucketRefsChangedEvent) changeRefIDs(typ string) map[string]bool {
-	var refIDs map[string]bool
+// changeRefIDs returns the IDs of the refs of the type given that
+// changed, each once, in order.
+func (e *bitbucketRefsChangedEvent) changeRefIDs(typ string) []string {
+	var refIDs []string
+	seen := make(map[string]bool)
 	for _, c := range e.Changes {
-		if c.Ref.Type != typ {
+		if c.Ref.Type != typ || seen[c.Ref.ID] {
 			continue
 		}
-		if refIDs == nil {
-			refIDs = make(map[string]bool)
-		}
-		refIDs[c.Ref.ID] = true
+		seen[c.Ref.ID] = true
+		refIDs = append(refIDs, c.Ref.ID)
 	}
 	return refIDs
 }
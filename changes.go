@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// Some events carry more than one change (e.g., a push of several
+// branches at once). All of them are tried, a few at a time, even if
+// some fail; and the response lists what came of each, so that the
+// source's record of deliveries says which made it.
+
+const maxConcurrentChanges = 4
+
+// changeOutcome is what the response says about one of the changes.
+type changeOutcome struct {
+	URL     string         `json:"url,omitempty"`
+	Ref     string         `json:"ref,omitempty"`
+	Image   string         `json:"image,omitempty"`
+	Result  string         `json:"result"`
+	Error   string         `json:"error,omitempty"`
+	Targets []targetResult `json:"targets,omitempty"`
+}
+
+func (res changeResult) outcome() changeOutcome {
+	o := changeOutcome{Result: res.Result, Error: res.Error, Targets: res.Targets}
+	switch src := res.Change.Source.(type) {
+	case fluxapi_v9.GitUpdate:
+		o.URL = src.URL
+		o.Ref = src.Branch
+	case fluxapi_v9.ImageUpdate:
+		o.Image = src.Name.String()
+	}
+	return o
+}
+
+// notifyChanges passes on each of the changes, at most
+// maxConcurrentChanges at a time, and returns the outcome for each, in
+// the same order. The error, if any, is a *fanoutError with those of
+// the changes that failed.
+func notifyChanges(ctx context.Context, s Notifier, changes []fluxapi_v9.Change) ([]changeOutcome, error) {
+	outcomes := make([]changeOutcome, len(changes))
+	errs := make([]error, len(changes))
+	sem := make(chan struct{}, maxConcurrentChanges)
+	var wg sync.WaitGroup
+	for i := range changes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// the recordingNotifier fills this in, if the delivery is
+			// being recorded
+			res := &changeResult{Change: changes[i]}
+			errs[i] = s.NotifyChange(context.WithValue(ctx, changeResultKey{}, res), changes[i])
+			switch {
+			case errs[i] != nil:
+				res.Result = resultError
+				res.Error = errs[i].Error()
+			case res.Result == "":
+				res.Result = resultOK
+			}
+			outcomes[i] = res.outcome()
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []string
+	var failedErrs []error
+	for i, o := range outcomes {
+		if errs[i] != nil {
+			name := o.Ref
+			if name == "" {
+				name = o.Image
+			}
+			failed = append(failed, name+": "+o.Error)
+			failedErrs = append(failedErrs, errs[i])
+		}
+	}
+	if len(failed) > 0 {
+		return outcomes, &fanoutError{
+			msg:  fmt.Sprintf("%d of %d changes failed: %s", len(failed), len(changes), strings.Join(failed, "; ")),
+			errs: failedErrs,
+		}
+	}
+	return outcomes, nil
+}
+
+// respondChanges answers a request with the outcome of each of its
+// changes, whatever the client accepts, since that's the point. If any
+// failed, the status is as it would be for a single change failing
+// (see notifyFailed).
+func respondChanges(w http.ResponseWriter, r *http.Request, source string, outcomes []changeOutcome, err error) {
+	resp := newDeliveryResponse(r, outcomes)
+	status := http.StatusOK
+	if err != nil {
+		status = failedStatus(source, err)
+		if status >= 500 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(downstreamRetryAfter/time.Second)))
+		}
+		resp.Error = downstreamMessage(status)
+		log(source, "error from downstream:", err.Error())
+	}
+	writeDeliveryResponse(w, status, resp)
+}
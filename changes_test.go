@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyChanges(t *testing.T) {
+	const repo = "git@github.com:example/config.git"
+	var changes []fluxapi_v9.Change
+	for _, branch := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		changes = append(changes, fluxapi_v9.Change{
+			Kind:   fluxapi_v9.GitChange,
+			Source: fluxapi_v9.GitUpdate{URL: repo, Branch: branch},
+		})
+	}
+
+	var mu sync.Mutex
+	var running, most int
+	notifier := notifierFunc(func(_ context.Context, change fluxapi_v9.Change) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if change.Source.(fluxapi_v9.GitUpdate).Branch == "b" {
+			return errors.New("nope")
+		}
+		return nil
+	})
+
+	outcomes, err := notifyChanges(context.Background(), notifier, changes)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadGateway, downstreamStatus(err))
+	assert.True(t, most <= maxConcurrentChanges)
+
+	// all are tried, and reported in order
+	if assert.Len(t, outcomes, len(changes)) {
+		assert.Equal(t, changeOutcome{URL: repo, Ref: "a", Result: resultOK}, outcomes[0])
+		assert.Equal(t, changeOutcome{URL: repo, Ref: "b", Result: resultError, Error: "nope"}, outcomes[1])
+		assert.Equal(t, changeOutcome{URL: repo, Ref: "g", Result: resultOK}, outcomes[6])
+	}
+}
+
+func TestBitbucketCloudPerRefResults(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), `"Branch":"broken"`) {
+			http.Error(w, "no", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer downstream.Close()
+
+	var payload map[string]interface{}
+	assert.NoError(t, json.Unmarshal(loadFixture(t, "bitbucket_cloud_payload"), &payload))
+	push := payload["push"].(map[string]interface{})
+	push["changes"] = []interface{}{
+		map[string]interface{}{"new": map[string]interface{}{"type": "branch", "name": "master"}},
+		map[string]interface{}{"new": map[string]interface{}{"type": "branch", "name": "broken"}},
+	}
+	body, err := json.Marshal(payload)
+	assert.NoError(t, err)
+
+	endpoint := Endpoint{Source: BitbucketCloud, KeyPath: "bitbucket_cloud_key"}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
+	assert.NoError(t, err)
+	req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Key", "repo:push")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var response struct {
+		Changes []changeOutcome `json:"changes"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	if assert.Len(t, response.Changes, 2) {
+		assert.Equal(t, "master", response.Changes[0].Ref)
+		assert.Equal(t, resultOK, response.Changes[0].Result)
+		assert.Equal(t, "broken", response.Changes[1].Ref)
+		assert.Equal(t, resultError, response.Changes[1].Result)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// When flux-recv is behind an ingress or load balancer, the remote
+// address of a request is that of the proxy rather than the client. A
+// proxy that is trusted can report the client address in a
+// `Forwarded` or `X-Forwarded-For` header; and, if the request went
+// through more than one proxy, each appends the address it saw. So the
+// client address is the rightmost address in that list that is _not_
+// a trusted proxy (anything to the left of that could have been made
+// up by the client).
+
+// parseCIDRs parses a list of CIDRs; bare IP addresses are also
+// accepted, and treated as a network of one.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("cannot parse %q as an IP address or CIDR", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q as an IP address or CIDR: %s", c, err.Error())
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type trustedProxies []*net.IPNet
+
+// clientIP figures out the address of the client that made the
+// request, taking forwarding headers into account only if they were
+// put there by a trusted proxy. It returns nil if the address cannot
+// be determined (e.g., a proxy reported an obfuscated identifier).
+func (proxies trustedProxies) clientIP(r *http.Request) net.IP {
+	remote := remoteIP(r)
+	if remote == nil || !containsIP(proxies, remote) {
+		return remote
+	}
+
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			return nil
+		}
+		if !containsIP(proxies, ip) {
+			return ip
+		}
+		remote = ip
+	}
+	// every hop was a trusted proxy; the best we can do is the
+	// furthest one
+	return remote
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedFor returns the list of addresses reported by proxies, in
+// the order they were added, preferring the standard `Forwarded`
+// header (RFC 7239) over `X-Forwarded-For`.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, line := range h["Forwarded"] {
+		for _, element := range strings.Split(line, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					hops = append(hops, forwardedNode(pair[4:]))
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, line := range h["X-Forwarded-For"] {
+		for _, addr := range strings.Split(line, ",") {
+			hops = append(hops, strings.TrimSpace(addr))
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips the quoting, brackets and port from a node in a
+// `Forwarded` header, e.g., `"[2001:db8:cafe::17]:4711"`.
+func forwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+type clientIPKey struct{}
+
+// withClientIP resolves the client address of each request, and
+// records it in the request context for handlers to use.
+func withClientIP(proxies trustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey{}, proxies.clientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the client address of the request, as resolved by
+// withClientIP; or, if the request didn't go through withClientIP,
+// the remote address.
+func clientIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPKey{}).(net.IP); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
@@ -1,27 +1,304 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"time"
 
 	"github.com/ghodss/yaml"
 )
 
+// GCRAuth says how to authenticate the OIDC tokens Pub/Sub attaches
+// to push requests.
 type GCRAuth struct {
+	// the audience configured for the push subscription
 	Audience string `json:"audience"`
+	// if set, the service account the push subscription uses; tokens
+	// issued to any other account are rejected
+	Email string `json:"email,omitempty"`
+	// where to get the keys that sign tokens; defaults to Google's
+	JWKSURL string `json:"jwksURL,omitempty"`
+}
+
+// IPAllowList restricts the client addresses from which an endpoint
+// will accept requests. The addresses are the union of those given
+// in CIDRs, and those loaded from the File or URL. A Preset names a
+// provider that publishes the addresses it sends webhooks from (one
+// of GitHub, BitbucketCloud, or GitLab), and supplies a default URL
+// and the format in which to parse the addresses.
+type IPAllowList struct {
+	CIDRs           []string `json:"cidrs,omitempty"`
+	Preset          string   `json:"preset,omitempty"`
+	File            string   `json:"file,omitempty"`
+	URL             string   `json:"url,omitempty"`
+	RefreshInterval Duration `json:"refreshInterval,omitempty"`
+}
+
+// Limit is a token bucket: requests are allowed at Rate per second on
+// average, in bursts of up to Burst.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// RateLimit limits requests in total, and from each client address.
+type RateLimit struct {
+	Total     *Limit `json:"total,omitempty"`
+	PerClient *Limit `json:"perClient,omitempty"`
 }
 
 type Endpoint struct {
-	Source       string   `json:"source"`
-	RegistryHost string   `json:"registryHost,omitempty"`
-	KeyPath      string   `json:"keyPath"`
-	GCR          *GCRAuth `json:"gcr,omitempty"`
+	// a name for the endpoint; needed if its key is to be derived from
+	// the master key
+	Name         string `json:"name,omitempty"`
+	Source       string `json:"source"`
+	RegistryHost string `json:"registryHost,omitempty"`
+	// where to find the key: a file (keyPath, or keyFile, which
+	// means the same), or an environment variable
+	KeyPath string `json:"keyPath,omitempty"`
+	KeyFile string `json:"keyFile,omitempty"`
+	KeyEnv  string `json:"keyEnv,omitempty"`
+	// whether to trim whitespace (e.g., a trailing newline) from the key
+	KeyTrim bool `json:"keyTrim,omitempty"`
+	// if the key is encoded, how: "base64" or "hex"
+	KeyEncoding string `json:"keyEncoding,omitempty"`
+
+	GCR        *GCRAuth     `json:"gcr,omitempty"`
+	AllowedIPs *IPAllowList `json:"allowedIPs,omitempty"`
+	RateLimit  *RateLimit   `json:"rateLimit,omitempty"`
+	// the largest request body accepted; defaults to 1MiB
+	MaxBodyBytes int64 `json:"maxBodyBytes,omitempty"`
+	// where to send changes; if not given, they go to the API given at
+	// the top level. Each change is sent to all of them.
+	Downstreams []Downstream `json:"downstreams,omitempty"`
+	// if true, changes are queued to be sent in the background, and
+	// requests answered without waiting
+	Async bool `json:"async,omitempty"`
+	// if set, repeats of a change (the same git repo and branch, or
+	// the same image) within this long of each other are coalesced
+	Debounce Duration `json:"debounce,omitempty"`
+	// if set, requests must present a client certificate signed by
+	// a CA in this file (needs TLS to be served by flux-recv)
+	ClientCAPath string `json:"clientCAPath,omitempty"`
+	// for GoogleContainerRegistry, where to keep messages acknowledged
+	// without being acted on
+	DeadLetter *DeadLetter `json:"deadLetter,omitempty"`
+	// receivers to which to forward a copy of each request handled
+	// successfully
+	Forward []Forward `json:"forward,omitempty"`
+	// if true, requests are only forwarded, and changes are not
+	// passed downstream
+	ForwardOnly bool `json:"forwardOnly,omitempty"`
+	// if true, changes are logged and given in the response, but not
+	// passed downstream (or forwarded)
+	DryRun bool `json:"dryRun,omitempty"`
+	// how to rewrite the URLs of git changes, so they match that
+	// given to fluxd
+	GitURL *GitURL `json:"gitURL,omitempty"`
+}
+
+// GitURLRewrite is a regular expression to match against a git URL,
+// and its replacement (in which $1 etc. are the groups matched).
+type GitURLRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// GitURL says how to rewrite the URLs in git changes (see giturl.go).
+type GitURL struct {
+	// put the URL in this form: "ssh" (git@host:path), "ssh-url"
+	// (ssh://git@host/path), or "https"
+	Form string `json:"form,omitempty"`
+	// replace the host (and port) with this, e.g., a mirror
+	Host string `json:"host,omitempty"`
+	// a template for the URL, in which {{.Host}}, {{.Path}}, {{.User}}
+	// and {{.URL}} are the parts of the URL (after any change of host)
+	Template string `json:"template,omitempty"`
+	// regular expressions to rewrite the URL with, each applied in
+	// turn to the result of the one before
+	Rewrite []GitURLRewrite `json:"rewrite,omitempty"`
+}
+
+// DeadLetter says where to keep messages that were acknowledged but
+// couldn't be acted on.
+type DeadLetter struct {
+	// a file to which to append the messages; if not given, only the
+	// most recent IDs are kept, in memory
+	Path string `json:"path,omitempty"`
+	// how many of the most recent to list; defaults to 20
+	Keep int `json:"keep,omitempty"`
+}
+
+// Forward is a receiver to which to forward requests.
+type Forward struct {
+	URL string `json:"url"`
+	// the request headers to forward; if not given, Content-Type,
+	// User-Agent, and X- headers
+	Headers []string `json:"headers,omitempty"`
+	// if given, a key with which to sign each request afresh (as
+	// GitHub does, with an HMAC-SHA256 of the body)
+	KeyPath string `json:"keyPath,omitempty"`
+	// the header for the signature; defaults to X-Hub-Signature-256
+	SignatureHeader string `json:"signatureHeader,omitempty"`
+	// as for Downstream
+	CAPath  string   `json:"caPath,omitempty"`
+	Proxy   string   `json:"proxy,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// SignatureFailures says when to act on requests that fail
+// verification (i.e., get a 401). Clients with too many failures are
+// banned for a while, if ban is true, and endpoints with too many
+// failures raise an alert.
+type SignatureFailures struct {
+	// whether to ban clients with too many failures; off by default,
+	// since without trustedProxies, a proxy in front of flux-recv
+	// would be taken for the client, and banned
+	Ban bool `json:"ban,omitempty"`
+	// failures from one client within the window that get it banned;
+	// defaults to 10
+	Threshold int `json:"threshold,omitempty"`
+	// failures at one endpoint, from any clients, within the window
+	// that raise an alert; defaults to 50
+	EndpointThreshold int `json:"endpointThreshold,omitempty"`
+	// defaults to 10m
+	Window Duration `json:"window,omitempty"`
+	// how long to ban clients for; defaults to 1h
+	BanDuration Duration `json:"banDuration,omitempty"`
+	// if set, alerts are POSTed to this URL, as JSON
+	AlertURL string `json:"alertURL,omitempty"`
+}
+
+// AuditLog says where to write a record of each delivery.
+type AuditLog struct {
+	// a file, or "-" for stdout; relative paths are relative to the
+	// config file
+	Path string `json:"path"`
+	// the size at which to rotate the file; defaults to 100MiB
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// how many rotated files to keep; defaults to 5
+	MaxBackups int `json:"maxBackups,omitempty"`
+}
+
+// Queue configures the queue for endpoints that are async.
+type Queue struct {
+	// how many changes can be queued; defaults to 1000
+	Size int `json:"size,omitempty"`
+	// how many changes are delivered at once; defaults to 4
+	Workers int `json:"workers,omitempty"`
+	// how long to keep trying to deliver a change; defaults to 1h
+	MaxAge Duration `json:"maxAge,omitempty"`
+	// how long to wait before retrying, at first (defaults to 1s) and
+	// at most (defaults to 5m)
+	MinBackoff Duration `json:"minBackoff,omitempty"`
+	MaxBackoff Duration `json:"maxBackoff,omitempty"`
+	// if set, the queue is also kept in this file, so that it
+	// survives restarts; changes older than maxAge are dropped when
+	// it's read back
+	Path string `json:"path,omitempty"`
+}
+
+// MasterKey is a key from which to derive the keys of endpoints that
+// don't have their own; it's given in the same ways as an endpoint's
+// key (and is always trimmed).
+type MasterKey struct {
+	Path     string `json:"path,omitempty"`
+	Env      string `json:"env,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// TLS gives the certificate and key with which to serve TLS.
+type TLS struct {
+	CertPath string `json:"certPath"`
+	KeyPath  string `json:"keyPath"`
+}
+
+// Downstream says how to connect to a Flux API. In the config, it can
+// be given as just the URL.
+type Downstream struct {
+	// "flux" (the default), for the Flux v1 API; "kubernetes", to
+	// annotate Flux v2 objects through the Kubernetes API; "http", to
+	// POST each change as JSON; or "file", to write each change as a
+	// line of JSON
+	Type string `json:"type,omitempty"`
+	URL  string `json:"url"`
+	// for type file, the file to append to; "-" means stdout
+	Path string `json:"path,omitempty"`
+	// a file containing a token to present to the API
+	TokenPath string `json:"tokenPath,omitempty"`
+	// a file containing CA certificates with which to verify the API
+	// server's certificate; if not set, the system CAs are used
+	CAPath string `json:"caPath,omitempty"`
+	// a client certificate and key to present to the API server
+	CertPath string `json:"certPath,omitempty"`
+	KeyPath  string `json:"keyPath,omitempty"`
+	// an HTTP proxy through which to connect; if not set, it's
+	// taken from the environment (HTTPS_PROXY etc.)
+	Proxy string `json:"proxy,omitempty"`
+	// how long to wait for a response to each request
+	Timeout Duration `json:"timeout,omitempty"`
+	// for type kubernetes, the namespaces in which to look for
+	// objects; if not set, all namespaces
+	Namespaces []string `json:"namespaces,omitempty"`
+	// for type kubernetes, the API versions to use for the objects
+	// annotated, if not the defaults
+	APIVersions KubeAPIVersions `json:"apiVersions,omitempty"`
+}
+
+// KubeAPIVersions are the API versions of the Flux v2 kinds a
+// downstream of type kubernetes annotates, each either a version
+// (e.g., v1beta2) or a group and version, as in a manifest (e.g.,
+// source.toolkit.fluxcd.io/v1beta2).
+type KubeAPIVersions struct {
+	// if not set, source.toolkit.fluxcd.io/v1
+	GitRepository string `json:"gitRepository,omitempty"`
+	// if not set, image.toolkit.fluxcd.io/v1beta2
+	ImageRepository string `json:"imageRepository,omitempty"`
+}
+
+func (d *Downstream) UnmarshalJSON(b []byte) error {
+	var url string
+	if err := json.Unmarshal(b, &url); err == nil {
+		*d = Downstream{URL: url}
+		return nil
+	}
+	type plain Downstream
+	return json.Unmarshal(b, (*plain)(d))
 }
 
 type Config struct {
 	FluxRecvVersion int        `json:"fluxRecvVersion"`
-	API             string     `json:"api"`
-	Endpoints       []Endpoint `json:"endpoints"`
+	API             Downstream `json:"api"`
+	// addresses (or CIDRs) of proxies, e.g., an ingress controller,
+	// that can be trusted to report the client address in
+	// X-Forwarded-For or Forwarded headers
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+	// limits applied across all endpoints
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	TLS       *TLS       `json:"tls,omitempty"`
+	MasterKey *MasterKey `json:"masterKey,omitempty"`
+	// what to do about requests that fail verification
+	SignatureFailures *SignatureFailures `json:"signatureFailures,omitempty"`
+	AuditLog          *AuditLog          `json:"auditLog,omitempty"`
+	Queue             *Queue             `json:"queue,omitempty"`
+	Endpoints         []Endpoint         `json:"endpoints"`
+}
+
+// Duration is a time.Duration given in the config as a string, e.g.,
+// "30s" or "1h".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %s", err.Error())
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
 }
 
 func ConfigFromBytes(configBytes []byte) (Config, error) {
@@ -33,12 +310,22 @@ func ConfigFromBytes(configBytes []byte) (Config, error) {
 	if config.FluxRecvVersion != 1 {
 		return config, fmt.Errorf("not a valid config file (field fluxRecvVersion != 1)")
 	}
+	names := map[string]bool{}
+	for _, ep := range config.Endpoints {
+		if ep.Name == "" {
+			continue
+		}
+		if names[ep.Name] {
+			return config, fmt.Errorf("more than one endpoint is named %q", ep.Name)
+		}
+		names[ep.Name] = true
+	}
 
 	return config, nil
 }
 
 func ConfigFromFile(path string) (Config, error) {
-	configBytes, err := ioutil.ReadFile(path)
+	configBytes, err := readSecretFile(path)
 	if err != nil {
 		return Config{}, err
 	}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -15,6 +16,27 @@ endpoints:
 - source: DockerHub
 `
 
+const badDuration = `
+fluxRecvVersion: 1
+endpoints:
+- source: GitHub
+  keyPath: ./github_rsa
+  allowedIPs:
+    preset: GitHub
+    refreshInterval: 30
+`
+
+const duplicateNames = `
+fluxRecvVersion: 1
+masterKey:
+  env: FLUXRECV_MASTER_KEY
+endpoints:
+- source: GitHub
+  name: app
+- source: GitLab
+  name: app
+`
+
 const completelyDifferentFile = `
 apiVersion: apps/v1
 kind: Deployment
@@ -32,6 +54,8 @@ func TestBadConfigs(t *testing.T) {
 	for name, testcase := range map[string]string{
 		"missing version":    missingVersion,
 		"wrong kind of file": completelyDifferentFile,
+		"bad duration":       badDuration,
+		"duplicate names":    duplicateNames,
 	} {
 		t.Run(name, func(t *testing.T) {
 			_, err := ConfigFromBytes([]byte(testcase))
@@ -50,6 +74,52 @@ endpoints:
   keyPath: ./dockerhub_rsa
 `
 
+const allowListConfig = `
+fluxRecvVersion: 1
+trustedProxies:
+- 10.0.0.0/8
+endpoints:
+- source: DockerHub
+  keyPath: ./dockerhub_rsa
+  allowedIPs:
+    cidrs:
+    - 192.0.2.0/24
+- source: GitHub
+  keyPath: ./github_rsa
+  allowedIPs:
+    preset: GitHub
+    refreshInterval: 30m
+`
+
+const apiConnectionConfig = `
+fluxRecvVersion: 1
+api:
+  url: https://flux.example.com/api/flux
+  tokenPath: ./flux-token
+  caPath: ./ca.crt
+  proxy: http://proxy.example.com:3128
+  timeout: 5s
+endpoints:
+- source: GitHub
+  keyPath: ./github_rsa
+`
+
+func TestAPIConfig(t *testing.T) {
+	config, err := ConfigFromBytes([]byte(fullConfig))
+	assert.NoError(t, err)
+	assert.Equal(t, Downstream{URL: "http://localhost:3031/api/flux"}, config.API)
+
+	config, err = ConfigFromBytes([]byte(apiConnectionConfig))
+	assert.NoError(t, err)
+	assert.Equal(t, Downstream{
+		URL:       "https://flux.example.com/api/flux",
+		TokenPath: "./flux-token",
+		CAPath:    "./ca.crt",
+		Proxy:     "http://proxy.example.com:3128",
+		Timeout:   Duration(5 * time.Second),
+	}, config.API)
+}
+
 const minimalConfig = `
 fluxRecvVersion: 1
 `
@@ -58,6 +128,7 @@ func TestGoodConfigs(t *testing.T) {
 	for name, testcase := range map[string]string{
 		"minimal":     minimalConfig,
 		"full config": fullConfig,
+		"allow lists": allowListConfig,
 	} {
 		t.Run(name, func(t *testing.T) {
 			_, err := ConfigFromBytes([]byte(testcase))
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pub/Sub redelivers a message until it's acknowledged, so a message
+// that can never be acted on (e.g., because it's malformed) has to be
+// acknowledged anyway, or it'll be redelivered for days. So that such
+// messages don't just disappear, they are "dead-lettered": logged,
+// and kept in a file, from which they can be replayed (see
+// replay-dead-letters), and the IDs of the last few listed in response
+// to a GET of the endpoint.
+
+const defaultDeadLetterKeep = 20
+
+type deadLetterRecord struct {
+	Time      time.Time `json:"time"`
+	MessageID string    `json:"messageId,omitempty"`
+	Reason    string    `json:"reason"`
+	// the request body, as received
+	Body []byte `json:"body,omitempty"`
+}
+
+type deadLetters struct {
+	path string
+	keep int
+
+	mu     sync.Mutex
+	recent []deadLetterRecord
+}
+
+// openDeadLetters opens the dead-letter file, if one is given, and
+// reads the records already in it, so that they are listed.
+func openDeadLetters(baseDir string, conf DeadLetter) (*deadLetters, error) {
+	if conf.Keep < 0 {
+		return nil, fmt.Errorf("deadLetter: keep must not be negative")
+	}
+	dl := &deadLetters{keep: conf.Keep}
+	if dl.keep == 0 {
+		dl.keep = defaultDeadLetterKeep
+	}
+	if conf.Path == "" {
+		return dl, nil
+	}
+	dl.path = configPath(baseDir, conf.Path)
+	records, err := readDeadLetters(dl.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("deadLetter: cannot read %s: %s", dl.path, err.Error())
+	}
+	for _, rec := range records {
+		dl.remember(rec)
+	}
+	return dl, nil
+}
+
+// readDeadLetters reads all the records in a dead-letter file.
+func readDeadLetters(path string) ([]deadLetterRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []deadLetterRecord
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// an incomplete last line is a record that didn't get
+			// written completely
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rec deadLetterRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err.Error())
+		}
+		records = append(records, rec)
+	}
+}
+
+// writeDeadLetters replaces the records in a dead-letter file.
+func writeDeadLetters(path string, records []deadLetterRecord) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// remember keeps the record (without the body) for listing. Call with
+// the lock held (or before the dead letters are in use).
+func (dl *deadLetters) remember(rec deadLetterRecord) {
+	rec.Body = nil
+	dl.recent = append(dl.recent, rec)
+	if len(dl.recent) > dl.keep {
+		dl.recent = dl.recent[len(dl.recent)-dl.keep:]
+	}
+}
+
+// add records a dead letter. The file is opened each time (dead
+// letters being few), so that it can be rewritten by
+// replay-dead-letters while flux-recv is running.
+func (dl *deadLetters) add(rec deadLetterRecord) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.remember(rec)
+	if dl.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dl.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// list responds to GET requests with the most recent dead letters,
+// newest first, and passes anything else on to the handler. A GET
+// needs the same token as a message from Pub/Sub; without gcr
+// authentication configured, there's no listing.
+func (dl *deadLetters) list(ep Endpoint, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ep.GCR == nil {
+			http.Error(w, "Listing dead letters needs gcr authentication to be configured", http.StatusForbidden)
+			return
+		}
+		if err := authenticateRequest(r.Context(), r.Header.Get("Authorization"), *ep.GCR); err != nil {
+			http.Error(w, "Cannot authorize request", http.StatusUnauthorized)
+			log(ep.Source, "listing dead letters:", err.Error())
+			return
+		}
+		markVerified(r)
+		dl.mu.Lock()
+		records := make([]deadLetterRecord, len(dl.recent))
+		for i, rec := range dl.recent {
+			records[len(records)-1-i] = rec
+		}
+		dl.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			DeadLetters []deadLetterRecord `json:"deadLetters"`
+		}{records})
+	})
+}
+
+type deadLettersKey struct{}
+
+// withDeadLetters makes the dead letters available to the handler.
+func withDeadLetters(dl *deadLetters, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), deadLettersKey{}, dl)))
+	})
+}
+
+func deadLettersFrom(ctx context.Context) *deadLetters {
+	dl, _ := ctx.Value(deadLettersKey{}).(*deadLetters)
+	return dl
+}
+
+// ackDeadLetter acknowledges a message that can't be acted on, and
+// keeps it as a dead letter, if the endpoint keeps them.
+func ackDeadLetter(w http.ResponseWriter, r *http.Request, source string, body []byte, messageID, reason string) {
+	log(source, "dead-lettering message", messageID+":", reason)
+	deadLettersMetric.WithLabelValues(source).Inc()
+	if dl := deadLettersFrom(r.Context()); dl != nil {
+		rec := deadLetterRecord{Time: time.Now().UTC(), MessageID: messageID, Reason: reason, Body: body}
+		if err := dl.add(rec); err != nil {
+			log(source, "could not record dead letter:", err.Error())
+		}
+	}
+	recordSkipped(r.Context(), messageID, reason)
+	respond(w, r, http.StatusOK, "Acknowledged, but not acted on: "+reason+"\n")
+}
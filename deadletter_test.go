@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCRDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-deadletter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "gcr_key"), loadFixture(t, "gcr_key"), 0600))
+
+	// a downstream that refuses changes
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusBadRequest)
+	}))
+	defer refusing.Close()
+
+	endpoint := Endpoint{
+		Name:       "gcr",
+		Source:     GoogleContainerRegistry,
+		KeyPath:    "gcr_key",
+		DeadLetter: &DeadLetter{Path: "dead-letters"},
+	}
+	post := func(api Downstream, body []byte) *httptest.ResponseRecorder {
+		_, handler, err := HandlerFromEndpoint(dir, api, endpoint)
+		assert.NoError(t, err)
+		req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the downstream being unavailable is worth a retry, whether it
+	// can't be reached, or answers that it's restarting or busy
+	rec := post(Downstream{URL: "http://127.0.0.1:1"}, loadFixture(t, "gcr_payload"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		status := status
+		restarting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "restarting", status)
+		}))
+		rec = post(Downstream{URL: restarting.URL}, loadFixture(t, "gcr_payload"))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		rec = post(Downstream{Type: downstreamHTTP, URL: restarting.URL}, loadFixture(t, "gcr_payload"))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		restarting.Close()
+	}
+
+	// the downstream refusing, or the message being malformed, isn't
+	rec = post(Downstream{URL: refusing.URL}, loadFixture(t, "gcr_payload"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = post(Downstream{URL: refusing.URL}, []byte(`{"message": {"data": "not base64!", "messageId": "42"}}`))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	records, err := readDeadLetters(filepath.Join(dir, "dead-letters"))
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "981636256311680", records[0].MessageID)
+	assert.Equal(t, loadFixture(t, "gcr_payload"), records[0].Body)
+
+	// listing needs gcr authentication
+	_, handler, err := HandlerFromEndpoint(dir, Downstream{URL: refusing.URL}, endpoint)
+	assert.NoError(t, err)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/hook/foo", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	signer := newTestSigner(t)
+	defer signer.jwks.Close()
+	listing := endpoint
+	listing.GCR = &GCRAuth{Audience: "gcr-update", JWKSURL: signer.jwks.URL}
+	token := signer.sign(t, map[string]interface{}{
+		"iss":            "https://accounts.google.com",
+		"aud":            "gcr-update",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"email":          "pusher@example.iam.gserviceaccount.com",
+		"email_verified": true,
+	})
+	get := func(ep Endpoint, token string) *httptest.ResponseRecorder {
+		_, handler, err := HandlerFromEndpoint(dir, Downstream{URL: refusing.URL}, ep)
+		assert.NoError(t, err)
+		req := httptest.NewRequest("GET", "/hook/foo", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(t, http.StatusUnauthorized, get(listing, "").Code)
+
+	// ... and is subject to the same restrictions as the hook
+	restricted := listing
+	restricted.AllowedIPs = &IPAllowList{CIDRs: []string{"198.51.100.0/24"}}
+	assert.Equal(t, http.StatusForbidden, get(restricted, token).Code)
+
+	// the most recent are listed, newest first
+	rec = get(listing, token)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var listed struct {
+		DeadLetters []deadLetterRecord `json:"deadLetters"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listed))
+	if assert.Len(t, listed.DeadLetters, 2) {
+		assert.Equal(t, "42", listed.DeadLetters[0].MessageID)
+		assert.Empty(t, listed.DeadLetters[0].Body)
+	}
+
+	// once the downstream is fixed, the refused change can be
+	// replayed; the malformed message stays
+	var called bool
+	fixed := newDownstream(t, expectedGoogleContainerRegistry, &called)
+	defer fixed.Close()
+	var out bytes.Buffer
+	config := Config{API: Downstream{URL: fixed.URL}, Endpoints: []Endpoint{endpoint}}
+	assert.NoError(t, replayDeadLetters(&out, dir, config, "gcr"))
+	assert.True(t, called)
+	assert.Contains(t, out.String(), "981636256311680  replayed")
+
+	records, err = readDeadLetters(filepath.Join(dir, "dead-letters"))
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "42", records[0].MessageID)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// Some sources send bursts of the same change, e.g., a CI pipeline
+// pushing ten tags of an image at once; and each notification makes
+// fluxd look again. An endpoint with a debounce window passes the
+// first of a burst on straight away, and then holds on to any more of
+// the same change that arrive within the window; if there were any,
+// one is passed on at the end of the window (which starts another
+// window).
+
+const resultCoalesced = "coalesced"
+
+type debouncer struct {
+	endpoint string
+	window   time.Duration
+	next     Notifier
+
+	mu      sync.Mutex
+	windows map[string]*debounceWindow
+}
+
+type debounceWindow struct {
+	// the latest change that arrived in the window, if any did
+	pending *fluxapi_v9.Change
+}
+
+func newDebouncer(endpoint string, window time.Duration, next Notifier) *debouncer {
+	return &debouncer{
+		endpoint: endpoint,
+		window:   window,
+		next:     next,
+		windows:  map[string]*debounceWindow{},
+	}
+}
+
+// changeKey says which changes are the same, for debouncing: those
+// for the same git repo and branch, or for the same image.
+func changeKey(change fluxapi_v9.Change) string {
+	switch src := change.Source.(type) {
+	case fluxapi_v9.GitUpdate:
+		return "git " + src.URL + " " + src.Branch
+	case fluxapi_v9.ImageUpdate:
+		return "image " + src.Name.String()
+	}
+	return string(change.Kind)
+}
+
+func (d *debouncer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	key := changeKey(change)
+	d.mu.Lock()
+	if w, ok := d.windows[key]; ok {
+		w.pending = &change
+		d.mu.Unlock()
+		coalescedChangesMetric.WithLabelValues(d.endpoint).Inc()
+		if res := changeResultFrom(ctx); res != nil {
+			res.Result = resultCoalesced
+		}
+		return nil
+	}
+	w := d.open(key)
+	d.mu.Unlock()
+
+	err := d.next.NotifyChange(ctx, change)
+	if err != nil {
+		// let the next one through, rather than holding it until the
+		// end of the window
+		d.mu.Lock()
+		if d.windows[key] == w && w.pending == nil {
+			delete(d.windows, key)
+		}
+		d.mu.Unlock()
+	}
+	return err
+}
+
+// open starts a window for the key. Call with the lock held.
+func (d *debouncer) open(key string) *debounceWindow {
+	w := &debounceWindow{}
+	d.windows[key] = w
+	time.AfterFunc(d.window, func() { d.close(key, w) })
+	return w
+}
+
+// close ends a window, and passes on the change that arrived in it,
+// if there was one.
+func (d *debouncer) close(key string, w *debounceWindow) {
+	d.mu.Lock()
+	if d.windows[key] != w {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.windows, key)
+	change := w.pending
+	if change != nil {
+		d.open(key)
+	}
+	d.mu.Unlock()
+
+	if change == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := d.next.NotifyChange(ctx, *change); err != nil {
+		log(d.endpoint, "could not pass on coalesced change:", err.Error())
+	}
+}
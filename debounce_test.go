@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebounce(t *testing.T) {
+	var mu sync.Mutex
+	var sent []fluxapi_v9.Change
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent)
+	}
+	d := newDebouncer("test", 100*time.Millisecond, notifierFunc(func(_ context.Context, change fluxapi_v9.Change) error {
+		mu.Lock()
+		sent = append(sent, change)
+		mu.Unlock()
+		return nil
+	}))
+
+	// the first is passed on straight away; the rest are held back
+	for i := 0; i < 5; i++ {
+		res := &changeResult{}
+		ctx := context.WithValue(context.Background(), changeResultKey{}, res)
+		assert.NoError(t, d.NotifyChange(ctx, testChange))
+		if i == 0 {
+			assert.Equal(t, "", res.Result)
+		} else {
+			assert.Equal(t, resultCoalesced, res.Result)
+		}
+	}
+	assert.Equal(t, 1, count())
+
+	// a different branch is a different change
+	other := fluxapi_v9.Change{
+		Kind:   fluxapi_v9.GitChange,
+		Source: fluxapi_v9.GitUpdate{URL: "git@github.com:example/config.git", Branch: "staging"},
+	}
+	assert.NoError(t, d.NotifyChange(context.Background(), other))
+	assert.Equal(t, 2, count())
+
+	// one of those held back is passed on at the end of the window
+	eventually(t, func() bool { return count() == 3 })
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 3, count())
+	mu.Lock()
+	assert.Equal(t, []fluxapi_v9.Change{testChange, other, testChange}, sent)
+	mu.Unlock()
+
+	// and once the windows have passed, changes go straight through
+	assert.NoError(t, d.NotifyChange(context.Background(), testChange))
+	assert.Equal(t, 4, count())
+}
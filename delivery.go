@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"golang.org/x/time/rate"
+)
+
+// Notifier is what the handlers tell about changes. It's the part of
+// the Flux API that flux-recv uses.
+type Notifier interface {
+	NotifyChange(context.Context, fluxapi_v9.Change) error
+}
+
+// Each request to an endpoint is a delivery, and gets a record of
+// what happened to it: who sent it, whether it was verified, and what
+// changes were extracted from it and passed on. The record is put in
+// the request context, so that the handler and the notifiers can add
+// to it; once the request has been handled, it goes to the audit log.
+
+const (
+	// the handler checked a signature or token, and it was good
+	verificationVerified = "verified"
+	// the handler checked a signature or token, and it was bad
+	verificationFailed = "failed"
+	// the handler has nothing to check (e.g., DockerHub, which relies
+	// on the URL being secret)
+	verificationNone = "none"
+	// the request was refused before it got to the handler (e.g.,
+	// because it came from an address not allowed)
+	verificationRefused = "refused"
+)
+
+const (
+	resultOK    = "ok"
+	resultError = "error"
+)
+
+// deliveryIDHeaders gives the header, if there is one, in which each
+// source sends an ID for the delivery. Sources without one get an ID
+// made up.
+var deliveryIDHeaders = map[string]string{}
+
+type delivery struct {
+	Time         time.Time       `json:"time"`
+	Endpoint     string          `json:"endpoint,omitempty"`
+	Source       string          `json:"source,omitempty"`
+	ClientIP     string          `json:"clientIP"`
+	DeliveryID   string          `json:"deliveryID"`
+	Path         string          `json:"path"`
+	DryRun       bool            `json:"dryRun,omitempty"`
+	Event        string          `json:"event,omitempty"`
+	Verification string          `json:"verification"`
+	Status       int             `json:"status"`
+	Changes      []changeResult  `json:"changes,omitempty"`
+	Skipped      []skippedChange `json:"skipped,omitempty"`
+	BodySHA256   string          `json:"bodySHA256,omitempty"`
+	BodyBytes    int64           `json:"bodyBytes"`
+
+	mu       sync.Mutex
+	verified bool
+	reached  bool
+}
+
+// changeResult is a change passed on downstream, and what came of it
+// (at each downstream, if there's more than one).
+type changeResult struct {
+	Change  fluxapi_v9.Change `json:"change"`
+	Result  string            `json:"result"`
+	Error   string            `json:"error,omitempty"`
+	Targets []targetResult    `json:"targets,omitempty"`
+}
+
+type deliveryKey struct{}
+
+type changeResultKey struct{}
+
+// changeResultFrom returns the result being recorded for the change
+// in hand, so that notifiers can add to it; or nil if it isn't being
+// recorded.
+func changeResultFrom(ctx context.Context) *changeResult {
+	res, _ := ctx.Value(changeResultKey{}).(*changeResult)
+	return res
+}
+
+// deliveryFrom returns the delivery record from the context, or nil
+// if there isn't one.
+func deliveryFrom(ctx context.Context) *delivery {
+	d, _ := ctx.Value(deliveryKey{}).(*delivery)
+	return d
+}
+
+// markVerified records that the request passed the handler's
+// signature or token check.
+func markVerified(r *http.Request) {
+	if d := deliveryFrom(r.Context()); d != nil {
+		d.mu.Lock()
+		d.verified = true
+		d.mu.Unlock()
+	}
+}
+
+// setDeliveryID records the ID of the delivery, for sources that send
+// it in the body rather than a header.
+func setDeliveryID(r *http.Request, id string) {
+	if d := deliveryFrom(r.Context()); d != nil && id != "" {
+		d.mu.Lock()
+		d.DeliveryID = id
+		d.mu.Unlock()
+	}
+}
+
+// recordChange records the result of passing on a change; if there
+// was no error, the result is "ok", unless a notifier has said
+// otherwise.
+func (d *delivery) recordChange(res *changeResult, err error) {
+	switch {
+	case err != nil:
+		res.Result = resultError
+		res.Error = err.Error()
+	case res.Result == "":
+		res.Result = resultOK
+	}
+	d.mu.Lock()
+	d.Changes = append(d.Changes, *res)
+	d.mu.Unlock()
+}
+
+// queued says whether any of the changes were queued rather than
+// delivered.
+func (d *delivery) queued() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.Changes {
+		if c.Result == resultQueued {
+			return true
+		}
+	}
+	return false
+}
+
+// recordingNotifier records each change, and the result of passing
+// it on, in the delivery.
+type recordingNotifier struct {
+	next Notifier
+}
+
+func (n recordingNotifier) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	d := deliveryFrom(ctx)
+	if d == nil {
+		return n.next.NotifyChange(ctx, change)
+	}
+	// the handler may have made the record already, so it can see
+	// what came of the change (see notifyChanges); it's of the change
+	// as passed on, e.g., with its git URL rewritten
+	res := changeResultFrom(ctx)
+	if res == nil {
+		res = &changeResult{Change: change}
+		ctx = context.WithValue(ctx, changeResultKey{}, res)
+	} else {
+		res.Change = change
+	}
+	err := n.next.NotifyChange(ctx, change)
+	d.recordChange(res, err)
+	return err
+}
+
+// reached wraps the handler for the source, to record that the
+// request got that far.
+func reached(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d := deliveryFrom(r.Context()); d != nil {
+			d.mu.Lock()
+			d.reached = true
+			d.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hashingBody hashes the request body as it's read.
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	n    int64
+	eof  bool
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	b.n += int64(n)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// trackDelivery puts a delivery record in the context of each request,
+// and when the request has been handled, fills in the outcome and
+// writes the record to the audit log (if there is one).
+func trackDelivery(endpoint, source string, maxBodyBytes int64, audit *auditLog, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := &delivery{
+			Time:     time.Now().UTC(),
+			Endpoint: endpoint,
+			Source:   source,
+			ClientIP: clientIP(r).String(),
+			Path:     r.URL.Path,
+		}
+		if h := deliveryIDHeaders[source]; h != "" {
+			d.DeliveryID = r.Header.Get(h)
+		}
+		var body *hashingBody
+		if r.Body != nil {
+			body = &hashingBody{ReadCloser: r.Body, hash: sha256.New()}
+			r.Body = body
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), deliveryKey{}, d)))
+
+		if body != nil {
+			// the hash is of the whole body, so read whatever the
+			// handler didn't (within the limit)
+			if !body.eof && body.n <= maxBodyBytes {
+				io.CopyN(ioutil.Discard, body, maxBodyBytes+1-body.n)
+			}
+			if body.eof && body.n <= maxBodyBytes {
+				d.BodySHA256 = hex.EncodeToString(body.hash.Sum(nil))
+			}
+			d.BodyBytes = body.n
+		}
+
+		d.mu.Lock()
+		d.Status = sw.status()
+		switch {
+		case d.verified:
+			d.Verification = verificationVerified
+		case d.Status == http.StatusUnauthorized:
+			d.Verification = verificationFailed
+		case d.reached:
+			d.Verification = verificationNone
+		default:
+			d.Verification = verificationRefused
+		}
+		if d.DeliveryID == "" {
+			d.DeliveryID = newDeliveryID()
+		}
+		d.mu.Unlock()
+
+		if audit != nil {
+			audit.write(d)
+		}
+	})
+}
+
+// Anyone can make requests to /hook/ paths that aren't endpoints (e.g.,
+// a scanner), so recording them is kept within bounds, lest they push
+// the records of real deliveries out of the audit log: their bodies
+// aren't read, and only so many a second are recorded; the rest are
+// just counted.
+const (
+	unknownHookRecordRate  = 1
+	unknownHookRecordBurst = 10
+)
+
+// trackUnknownHooks answers requests to /hook/ paths that aren't
+// endpoints with 404, and records them (up to the limit).
+func trackUnknownHooks(audit *auditLog) http.Handler {
+	limiter := rate.NewLimiter(unknownHookRecordRate, unknownHookRecordBurst)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+		if audit == nil {
+			return
+		}
+		if !limiter.Allow() {
+			unrecordedRequestsMetric.Inc()
+			return
+		}
+		audit.write(&delivery{
+			Time:         time.Now().UTC(),
+			ClientIP:     clientIP(r).String(),
+			DeliveryID:   newDeliveryID(),
+			Path:         r.URL.Path,
+			Verification: verificationRefused,
+			Status:       http.StatusNotFound,
+		})
+	})
+}
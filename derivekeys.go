@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	flag "github.com/spf13/pflag"
+)
+
+// deriveKeysMain is the `derive-keys` subcommand, which prints the key
+// and hook URL of each endpoint, so they can be entered into the
+// webhook settings at the source.
+func deriveKeysMain(args []string) {
+	var (
+		configFile       string
+		baseURL          string
+		ageIdentityFiles []string
+	)
+
+	flags := flag.NewFlagSet("flux-recv derive-keys", flag.ExitOnError)
+	flags.StringVar(&configFile, "config", "fluxrecv.yaml", "path to config file for flux-recv")
+	flags.StringVar(&baseURL, "base-url", "", "the URL at which flux-recv is exposed, e.g., https://hooks.example.com; if not given, only the path of each hook is printed")
+	flags.StringSliceVar(&ageIdentityFiles, "age-identity", nil, "path to a file of age identities with which to decrypt the config and key files, if they are encrypted")
+
+	bail := func(msg string) {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+
+	flags.Parse(args)
+
+	if err := loadAgeIdentities(ageIdentityFiles); err != nil {
+		bail(err.Error())
+	}
+	config, err := ConfigFromFile(configFile)
+	if err != nil {
+		bail(err.Error())
+	}
+	if err := deriveKeys(os.Stdout, filepath.Dir(configFile), config, baseURL); err != nil {
+		bail(err.Error())
+	}
+}
+
+// deriveKeys writes a table of the endpoints in the config, with their
+// hook URLs, and their keys where they are derived from the master
+// key. Keys that are given in files or the environment aren't printed,
+// since they are already known.
+func deriveKeys(out io.Writer, baseDir string, config Config, baseURL string) error {
+	var master []byte
+	if config.MasterKey != nil {
+		var err error
+		if master, err = loadMasterKey(baseDir, *config.MasterKey); err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSOURCE\tURL\tKEY")
+	for _, ep := range config.Endpoints {
+		key, err := endpointKey(baseDir, ep, master)
+		if err != nil {
+			return fmt.Errorf("endpoint for %s: %s", ep.Source, err.Error())
+		}
+		shown := string(key)
+		if ep.hasOwnKey() {
+			shown = "(" + ep.keyDescription(baseDir) + ")"
+		}
+		name := ep.Name
+		if name == "" {
+			name = "-"
+		}
+		url := strings.TrimSuffix(baseURL, "/") + "/hook/" + endpointDigest(key, ep)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, ep.Source, url, shown)
+	}
+	return w.Flush()
+}
@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-
-	fluxapi "github.com/fluxcd/flux/pkg/api"
 )
 
 const DockerHub = "DockerHub"
@@ -13,7 +11,7 @@ func init() {
 	Sources[DockerHub] = handleDockerhub
 }
 
-func handleDockerhub(s fluxapi.Server, _ []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
+func handleDockerhub(s Notifier, _ []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
 	type payload struct {
 		Repository struct {
 			RepoName string `json:"repo_name"`
@@ -25,5 +23,5 @@ func handleDockerhub(s fluxapi.Server, _ []byte, w http.ResponseWriter, r *http.
 		log(DockerHub, err.Error())
 		return
 	}
-	doImageNotify(s, w, r, p.Repository.RepoName)
+	doImageNotify(s, w, r, DockerHub, p.Repository.RepoName)
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	fluxhttp "github.com/fluxcd/flux/pkg/http"
+	fluxclient "github.com/fluxcd/flux/pkg/http/client"
+)
+
+// Types of downstream
+const (
+	downstreamFlux       = "flux"
+	downstreamKubernetes = "kubernetes"
+	downstreamHTTP       = "http"
+	downstreamFile       = "file"
+)
+
+// These are for the connections to the Flux API. Notifications are
+// small and infrequent, so there's no need for many idle connections;
+// but it's worth keeping some, so that each notification doesn't need
+// a new TLS handshake.
+const (
+	downstreamDialTimeout      = 5 * time.Second
+	downstreamTLSTimeout       = 5 * time.Second
+	downstreamIdleConns        = 4
+	downstreamIdleConnsTimeout = 90 * time.Second
+)
+
+// httpClient constructs an HTTP client according to the connection
+// settings. Paths are relative to baseDir.
+func (d Downstream) httpClient(baseDir string) (*http.Client, error) {
+	transport, err := d.transport(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(d.Timeout),
+	}, nil
+}
+
+// transportKey is the connection settings a transport is made from,
+// with paths resolved.
+type transportKey struct {
+	caPath, certPath, keyPath, proxy string
+}
+
+// Downstreams (and forwarding targets) with the same connection
+// settings share a transport, and with it, its idle connections.
+var transports = struct {
+	sync.Mutex
+	m map[transportKey]*http.Transport
+}{m: map[transportKey]*http.Transport{}}
+
+// transport returns the transport for the connection settings,
+// constructing it if there isn't one already.
+func (d Downstream) transport(baseDir string) (*http.Transport, error) {
+	key := transportKey{proxy: d.Proxy}
+	if d.CAPath != "" {
+		key.caPath = configPath(baseDir, d.CAPath)
+	}
+	if d.CertPath != "" {
+		key.certPath = configPath(baseDir, d.CertPath)
+	}
+	if d.KeyPath != "" {
+		key.keyPath = configPath(baseDir, d.KeyPath)
+	}
+
+	transports.Lock()
+	defer transports.Unlock()
+	if t, ok := transports.m[key]; ok {
+		return t, nil
+	}
+	t, err := newTransport(key)
+	if err != nil {
+		return nil, err
+	}
+	transports.m[key] = t
+	return t, nil
+}
+
+func newTransport(key transportKey) (*http.Transport, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if key.caPath != "" {
+		pool, err := loadCertPool(key.caPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load CA bundle: %s", err.Error())
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (key.certPath == "") != (key.keyPath == "") {
+		return nil, fmt.Errorf("both certPath and keyPath are needed for a client certificate")
+	}
+	if key.certPath != "" {
+		cert, err := tls.LoadX509KeyPair(key.certPath, key.keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if key.proxy != "" {
+		proxyURL, err := url.Parse(key.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse proxy URL: %s", err.Error())
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   downstreamDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: downstreamTLSTimeout,
+		MaxIdleConnsPerHost: downstreamIdleConns,
+		IdleConnTimeout:     downstreamIdleConnsTimeout,
+	}, nil
+}
+
+// configPath resolves a path given in the config, relative to
+// baseDir.
+func configPath(baseDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+// apiURL is the URL of the Flux API, which defaults to that of a fluxd
+// running alongside; or for type kubernetes, of the Kubernetes API,
+// which defaults to that of the cluster flux-recv is running in.
+func (d Downstream) apiURL() string {
+	if d.URL != "" {
+		return d.URL
+	}
+	if d.Type == downstreamKubernetes {
+		return inClusterAPIURL()
+	}
+	return defaultApiBase
+}
+
+// name is how the downstream is referred to, e.g., in the audit log.
+func (d Downstream) name() string {
+	if d.Type == downstreamFile {
+		if d.Path == "-" {
+			return "stdout"
+		}
+		return d.Path
+	}
+	return d.apiURL()
+}
+
+// NotifierConstructor constructs a Notifier for a downstream. Paths
+// are relative to baseDir.
+type NotifierConstructor func(baseDir string, d Downstream) (Notifier, error)
+
+// Notifiers has a constructor for each type of downstream.
+var Notifiers = map[string]NotifierConstructor{}
+
+func init() {
+	Notifiers[downstreamFlux] = func(baseDir string, d Downstream) (Notifier, error) {
+		client, err := d.fluxClient(baseDir)
+		if err != nil {
+			return nil, err
+		}
+		return fluxNotifier{client}, nil
+	}
+}
+
+// notifier constructs a Notifier for the downstream, according to its
+// type.
+func (d Downstream) notifier(baseDir string) (Notifier, error) {
+	typ := d.Type
+	if typ == "" {
+		typ = downstreamFlux
+	}
+	construct, ok := Notifiers[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", d.Type)
+	}
+	return construct(baseDir, d)
+}
+
+// check checks the downstream's settings as far as it can without
+// constructing a notifier; that is, without setting up connections or
+// opening (or creating) files. It's for a dry run, which sends
+// nothing downstream.
+func (d Downstream) check() error {
+	typ := d.Type
+	if typ == "" {
+		typ = downstreamFlux
+	}
+	if _, ok := Notifiers[typ]; !ok {
+		return fmt.Errorf("unknown type %q", d.Type)
+	}
+	switch typ {
+	case downstreamFile:
+		if d.Path == "" {
+			return fmt.Errorf("path is required")
+		}
+		return nil
+	case downstreamHTTP:
+		if d.URL == "" {
+			return fmt.Errorf("url is required")
+		}
+	case downstreamKubernetes:
+		if _, _, err := d.kubeKinds(); err != nil {
+			return err
+		}
+	}
+	if (d.CertPath == "") != (d.KeyPath == "") {
+		return fmt.Errorf("both certPath and keyPath are needed for a client certificate")
+	}
+	if d.Proxy != "" {
+		if _, err := url.Parse(d.Proxy); err != nil {
+			return fmt.Errorf("cannot parse proxy URL: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// fluxClient constructs a client for the Flux API described.
+func (d Downstream) fluxClient(baseDir string) (*fluxclient.Client, error) {
+	client, err := d.httpClient(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport = statusRecorder{client.Transport}
+	var token string
+	if d.TokenPath != "" {
+		bytes, err := readSecretFile(configPath(baseDir, d.TokenPath))
+		if err != nil {
+			return nil, fmt.Errorf("cannot load API token: %s", err.Error())
+		}
+		token = strings.TrimSpace(string(bytes))
+	}
+	return fluxclient.New(client, fluxhttp.NewAPIRouter(), d.apiURL(), fluxclient.Token(token)), nil
+}
+
+// The Flux API client doesn't keep the status of an error response, so
+// it's recorded on the way through, for fluxNotifier.
+
+type responseStatusKey struct{}
+
+type statusRecorder struct {
+	next http.RoundTripper
+}
+
+func (t statusRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if status, ok := req.Context().Value(responseStatusKey{}).(*int); ok && err == nil {
+		*status = resp.StatusCode
+	}
+	return resp, err
+}
+
+// fluxNotifier notifies the Flux API, returning an error response as a
+// responseError.
+type fluxNotifier struct {
+	*fluxclient.Client
+}
+
+func (n fluxNotifier) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	var status int
+	err := n.Client.NotifyChange(context.WithValue(ctx, responseStatusKey{}, &status), change)
+	if err != nil && status != 0 {
+		return &responseError{status: status, err: err}
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that the connection settings for the API are used: the API
+// here is served over TLS with a certificate signed by its own CA, and
+// requires a token.
+func Test_DownstreamConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-downstream")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var called bool
+	downstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Scope-Probe token=s3cr3t" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		called = true
+		fmt.Fprintln(w, `{"status": "OK"}`)
+	}))
+	defer downstream.Close()
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: downstream.Certificate().Raw})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), caPEM, 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("s3cr3t\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dockerhub_key"), loadFixture(t, "dockerhub_key"), 0600))
+
+	for _, tt := range []struct {
+		desc     string
+		api      Downstream
+		status   int
+		notified bool
+	}{
+		{
+			desc:     "with CA and token",
+			api:      Downstream{URL: downstream.URL, CAPath: "ca.crt", TokenPath: "token"},
+			status:   http.StatusOK,
+			notified: true,
+		},
+		{
+			desc:   "without token",
+			api:    Downstream{URL: downstream.URL, CAPath: "ca.crt"},
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "without CA",
+			api:    Downstream{URL: downstream.URL, TokenPath: "token"},
+			status: http.StatusBadGateway,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			endpoint := Endpoint{Source: GitLab, KeyPath: "dockerhub_key"}
+			_, handler, err := HandlerFromEndpoint(dir, tt.api, endpoint)
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "gitlab_payload")))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Gitlab-Event", "Push Hook")
+			req.Header.Set("X-Gitlab-Token", string(loadFixture(t, "dockerhub_key")))
+			rec := httptest.NewRecorder()
+
+			called = false
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, tt.notified, called)
+		})
+	}
+}
+
+// Downstreams with the same connection settings share a transport,
+// whatever else differs (e.g., the URL, or the timeout).
+func Test_DownstreamTransport(t *testing.T) {
+	a, err := Downstream{URL: "http://flux-a:3030/api/flux", Timeout: Duration(time.Second)}.httpClient("")
+	assert.NoError(t, err)
+	b, err := Downstream{URL: "http://flux-b:3030/api/flux"}.httpClient("")
+	assert.NoError(t, err)
+	c, err := Downstream{URL: "http://flux-c:3030/api/flux", Proxy: "http://proxy:8080"}.httpClient("")
+	assert.NoError(t, err)
+	assert.True(t, a.Transport == b.Transport)
+	assert.False(t, a.Transport == c.Transport)
+	assert.Equal(t, time.Second, a.Timeout)
+
+	// a path is the same whether given relative to the base dir or not
+	dir, err := ioutil.TempDir("", "flux-recv-downstream")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), caPEM, 0600))
+	d, err := Downstream{CAPath: "ca.crt"}.transport(dir)
+	assert.NoError(t, err)
+	e, err := Downstream{CAPath: filepath.Join(dir, "ca.crt")}.transport("")
+	assert.NoError(t, err)
+	assert.True(t, d == e)
+	assert.False(t, d == a.Transport)
+}
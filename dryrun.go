@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// In a dry run, requests are verified and parsed as usual, but the
+// changes that would be passed on are only logged and given in the
+// response; nothing is sent downstream, or forwarded. This is so hooks
+// can be installed before they are enabled, and new configuration
+// tried out safely.
+
+const resultDryRun = "dry-run"
+
+// dryRunNotifier logs each change, rather than passing it on.
+type dryRunNotifier struct {
+	endpoint string
+}
+
+func (n dryRunNotifier) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	if res := changeResultFrom(ctx); res != nil {
+		res.Result = resultDryRun
+	}
+	bytes, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	log(n.endpoint, "dry run, not passing on change:", string(bytes))
+	return nil
+}
+
+// markDryRun records that the request is for a dry run, so the
+// response gives the changes whatever the client accepts.
+func markDryRun(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d := deliveryFrom(r.Context()); d != nil {
+			d.mu.Lock()
+			d.DryRun = true
+			d.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isDryRun says whether the request is for a dry run.
+func isDryRun(r *http.Request) bool {
+	d := deliveryFrom(r.Context())
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.DryRun
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRun(t *testing.T) {
+	downstream := &flakyDownstream{}
+	downstreamServer := httptest.NewServer(downstream)
+	defer downstreamServer.Close()
+	receiver := &forwardReceiver{}
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+
+	endpoint := Endpoint{
+		Source:  GitLab,
+		KeyPath: "dockerhub_key",
+		KeyTrim: true,
+		Forward: []Forward{{URL: receiverServer.URL}},
+	}
+
+	for _, tt := range []struct {
+		desc     string
+		endpoint func(Endpoint) Endpoint
+		opts     []HandlerOption
+	}{
+		{"endpoint", func(ep Endpoint) Endpoint { ep.DryRun = true; return ep }, nil},
+		{"everywhere", func(ep Endpoint) Endpoint { return ep }, []HandlerOption{WithDryRun()}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstreamServer.URL}, tt.endpoint(endpoint), tt.opts...)
+			assert.NoError(t, err)
+
+			// the changes are in the response, even though JSON
+			// wasn't asked for
+			rec := sendTrimmedGitlabPush(t, handler)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			var resp deliveryResponse
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.True(t, resp.DryRun)
+			if assert.Len(t, resp.Changes, 1) {
+				assert.Equal(t, "master", resp.Changes[0].Ref)
+				assert.Equal(t, resultDryRun, resp.Changes[0].Result)
+			}
+
+			// but nothing went downstream, or was forwarded
+			time.Sleep(50 * time.Millisecond)
+			calls, _ := downstream.counts()
+			assert.Equal(t, 0, calls)
+			assert.Equal(t, 0, receiver.count())
+		})
+	}
+}
+
+func TestDryRunAsync(t *testing.T) {
+	q, err := newQueue("", Queue{})
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "flux-recv-dryrun")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	endpoint := Endpoint{
+		Source:      GitLab,
+		KeyPath:     "dockerhub_key",
+		KeyTrim:     true,
+		Async:       true,
+		DryRun:      true,
+		Downstreams: []Downstream{{Type: downstreamFile, Path: filepath.Join(dir, "changes.jsonl")}},
+	}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{}, endpoint, WithQueue(q))
+	assert.NoError(t, err)
+
+	// nothing is queued, so it's OK rather than Accepted
+	rec := sendTrimmedGitlabPush(t, handler)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp deliveryResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	if assert.Len(t, resp.Changes, 1) {
+		assert.Equal(t, resultDryRun, resp.Changes[0].Result)
+	}
+
+	// and the file downstream wasn't created
+	_, err = os.Stat(endpoint.Downstreams[0].Path)
+	assert.True(t, os.IsNotExist(err))
+
+	// a downstream that can't be used is still reported
+	endpoint.Downstreams = []Downstream{{Type: downstreamFile}}
+	_, _, err = HandlerFromEndpoint("test/fixtures", Downstream{}, endpoint, WithQueue(q))
+	assert.Error(t, err)
+}
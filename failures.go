@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Requests failing verification now and then is expected (e.g., while
+// a key is being rotated); but lots of failures from one client means
+// it's probing with forged requests, and lots at one endpoint means
+// someone is trying hard to get in, perhaps from many addresses. The
+// first gets the client banned for a while, if bans are turned on, and
+// both raise a security event: a log line, a metric, and optionally a
+// webhook of our own.
+//
+// Bans are off unless asked for, since behind a proxy that isn't in
+// trustedProxies, every request seems to come from the proxy, and
+// banning it would shut everyone out. Even with bans on, a client
+// isn't banned if its address is that of a trusted proxy (i.e., the
+// real client couldn't be told), or couldn't be worked out at all.
+
+const (
+	defaultFailureThreshold         = 10
+	defaultEndpointFailureThreshold = 50
+	defaultFailureWindow            = 10 * time.Minute
+	defaultBanDuration              = time.Hour
+
+	// how often to forget failures that have dropped out of the window
+	failureSweepInterval = time.Minute
+	// how long to wait for the alert webhook to respond
+	alertTimeout = 10 * time.Second
+)
+
+const (
+	eventClientBanned   = "client_banned"
+	eventEndpointProbed = "endpoint_probed"
+)
+
+// securityEvent is what's logged, and sent to the alert URL.
+type securityEvent struct {
+	Event       string     `json:"event"`
+	Severity    string     `json:"severity"`
+	Endpoint    string     `json:"endpoint"`
+	Client      string     `json:"client,omitempty"`
+	Failures    int        `json:"failures"`
+	Window      string     `json:"window"`
+	BannedUntil *time.Time `json:"bannedUntil,omitempty"`
+	Time        time.Time  `json:"time"`
+}
+
+type failureTracker struct {
+	threshold         int
+	endpointThreshold int
+	window            time.Duration
+	banDuration       time.Duration
+	alertURL          string
+	ban               bool
+	proxies           trustedProxies
+
+	mu        sync.Mutex
+	clients   map[string]*failureCount
+	endpoints map[string]*failureCount
+	banned    map[string]time.Time
+	nextSweep time.Time
+
+	// so tests can wait for alerts to be sent
+	alerts sync.WaitGroup
+}
+
+type failureCount struct {
+	times []time.Time
+	// when an alert was last raised, so it's raised at most once per
+	// window
+	alerted time.Time
+}
+
+// add records a failure and returns the number of failures within the
+// window.
+func (c *failureCount) add(now time.Time, window time.Duration) int {
+	c.prune(now, window)
+	c.times = append(c.times, now)
+	return len(c.times)
+}
+
+func (c *failureCount) prune(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(c.times) && now.Sub(c.times[i]) >= window {
+		i++
+	}
+	c.times = c.times[i:]
+}
+
+func newFailureTracker(conf SignatureFailures, proxies trustedProxies) (*failureTracker, error) {
+	if conf.Threshold < 0 || conf.EndpointThreshold < 0 || conf.Window < 0 || conf.BanDuration < 0 {
+		return nil, fmt.Errorf("signatureFailures: thresholds and durations must not be negative")
+	}
+	t := &failureTracker{
+		threshold:         conf.Threshold,
+		endpointThreshold: conf.EndpointThreshold,
+		window:            time.Duration(conf.Window),
+		banDuration:       time.Duration(conf.BanDuration),
+		alertURL:          conf.AlertURL,
+		ban:               conf.Ban,
+		proxies:           proxies,
+		clients:           map[string]*failureCount{},
+		endpoints:         map[string]*failureCount{},
+		banned:            map[string]time.Time{},
+	}
+	if t.threshold == 0 {
+		t.threshold = defaultFailureThreshold
+	}
+	if t.endpointThreshold == 0 {
+		t.endpointThreshold = defaultEndpointFailureThreshold
+	}
+	if t.window == 0 {
+		t.window = defaultFailureWindow
+	}
+	if t.banDuration == 0 {
+		t.banDuration = defaultBanDuration
+	}
+	return t, nil
+}
+
+// bannedFor says how much longer the client is banned for, if it is
+// banned.
+func (t *failureTracker) bannedFor(client string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.banned[client]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(t.banned, client)
+		bannedClientsMetric.Set(float64(len(t.banned)))
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// fail records a failure from the client at the endpoint, and returns
+// any security events that follow from it. The client is "" if it
+// mustn't be banned (see bannable).
+func (t *failureTracker) fail(endpoint, client string, now time.Time) []securityEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var events []securityEvent
+	window := t.window.String()
+
+	if t.ban && client != "" {
+		c, ok := t.clients[client]
+		if !ok {
+			c = &failureCount{}
+			t.clients[client] = c
+		}
+		if n := c.add(now, t.window); n >= t.threshold {
+			until := now.Add(t.banDuration)
+			t.banned[client] = until
+			bannedClientsMetric.Set(float64(len(t.banned)))
+			delete(t.clients, client)
+			events = append(events, securityEvent{
+				Event:       eventClientBanned,
+				Endpoint:    endpoint,
+				Client:      client,
+				Failures:    n,
+				Window:      window,
+				BannedUntil: &until,
+			})
+		}
+	}
+
+	e, ok := t.endpoints[endpoint]
+	if !ok {
+		e = &failureCount{}
+		t.endpoints[endpoint] = e
+	}
+	if n := e.add(now, t.window); n >= t.endpointThreshold && now.Sub(e.alerted) >= t.window {
+		e.alerted = now
+		events = append(events, securityEvent{
+			Event:    eventEndpointProbed,
+			Endpoint: endpoint,
+			Failures: n,
+			Window:   window,
+		})
+	}
+
+	t.sweep(now)
+	for i := range events {
+		events[i].Severity = "high"
+		events[i].Time = now.UTC()
+	}
+	return events
+}
+
+// sweep forgets failures that are outside the window. Call with the
+// lock held.
+func (t *failureTracker) sweep(now time.Time) {
+	if now.Before(t.nextSweep) {
+		return
+	}
+	t.nextSweep = now.Add(failureSweepInterval)
+	for _, counts := range []map[string]*failureCount{t.clients, t.endpoints} {
+		for k, c := range counts {
+			c.prune(now, t.window)
+			if len(c.times) == 0 && now.Sub(c.alerted) >= t.window {
+				delete(counts, k)
+			}
+		}
+	}
+	for client, until := range t.banned {
+		if !now.Before(until) {
+			delete(t.banned, client)
+		}
+	}
+	bannedClientsMetric.Set(float64(len(t.banned)))
+}
+
+// raise reports a security event: it's logged distinctly from other
+// failures, counted, and sent to the alert URL if there is one.
+func (t *failureTracker) raise(ev securityEvent) {
+	switch ev.Event {
+	case eventClientBanned:
+		log("SECURITY [high]: client", ev.Client, "banned until", ev.BannedUntil.UTC().Format(time.RFC3339), "after", ev.Failures, "failed verifications in", ev.Window, "at", ev.Endpoint)
+	default:
+		log("SECURITY [high]:", ev.Endpoint, "had", ev.Failures, "failed verifications in", ev.Window)
+	}
+	securityEventsMetric.WithLabelValues(ev.Event).Inc()
+
+	if t.alertURL != "" {
+		t.alerts.Add(1)
+		go func() {
+			defer t.alerts.Done()
+			if err := t.sendAlert(ev); err != nil {
+				log("could not send security alert to", t.alertURL+":", err.Error())
+			}
+		}()
+	}
+}
+
+func (t *failureTracker) sendAlert(ev securityEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", t.alertURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("response status %s", resp.Status)
+	}
+	return nil
+}
+
+// bannable returns the client address of the request, if it's one
+// that can be banned; or "" if it's unknown, or that of a trusted proxy.
+func (t *failureTracker) bannable(r *http.Request) string {
+	ip := clientIP(r)
+	if ip == nil || containsIP(t.proxies, ip) {
+		return ""
+	}
+	return ip.String()
+}
+
+// wrap refuses requests from banned clients, and counts the requests
+// that the handler given says are unauthorized.
+func (t *failureTracker) wrap(endpoint string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := t.bannable(r)
+		if d := t.bannedFor(client, time.Now()); d > 0 {
+			bannedRequestsMetric.WithLabelValues(endpoint).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status() == http.StatusUnauthorized {
+			signatureFailuresMetric.WithLabelValues(endpoint).Inc()
+			for _, ev := range t.fail(endpoint, client, time.Now()) {
+				t.raise(ev)
+			}
+		}
+	})
+}
+
+// statusWriter remembers the status code written.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureTracker(t *testing.T) {
+	tracker, err := newFailureTracker(SignatureFailures{
+		Ban:               true,
+		Threshold:         3,
+		EndpointThreshold: 4,
+		Window:            Duration(time.Minute),
+		BanDuration:       Duration(time.Hour),
+	}, nil)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	// failures spread out further than the window don't add up
+	assert.Empty(t, tracker.fail("app", "1.2.3.4", now))
+	assert.Empty(t, tracker.fail("app", "1.2.3.4", now.Add(time.Minute)))
+	assert.Empty(t, tracker.fail("app", "1.2.3.4", now.Add(2*time.Minute)))
+	assert.Zero(t, tracker.bannedFor("1.2.3.4", now.Add(2*time.Minute)))
+
+	now = now.Add(time.Hour)
+	assert.Empty(t, tracker.fail("app", "1.2.3.4", now))
+	assert.Empty(t, tracker.fail("app", "5.6.7.8", now))
+	assert.Empty(t, tracker.fail("app", "1.2.3.4", now))
+	events := tracker.fail("app", "1.2.3.4", now)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, eventClientBanned, events[0].Event)
+		assert.Equal(t, "1.2.3.4", events[0].Client)
+		assert.Equal(t, 3, events[0].Failures)
+		assert.Equal(t, eventEndpointProbed, events[1].Event)
+		assert.Equal(t, 4, events[1].Failures)
+	}
+
+	assert.Equal(t, time.Hour, tracker.bannedFor("1.2.3.4", now))
+	assert.Zero(t, tracker.bannedFor("5.6.7.8", now))
+	assert.Zero(t, tracker.bannedFor("1.2.3.4", now.Add(time.Hour)))
+
+	// an endpoint alert is raised at most once per window
+	assert.Empty(t, tracker.fail("app", "5.6.7.8", now))
+}
+
+func Test_SignatureFailureBans(t *testing.T) {
+	alerts := make(chan securityEvent, 10)
+	alertServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev securityEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&ev))
+		alerts <- ev
+	}))
+	defer alertServer.Close()
+
+	tracker, err := newFailureTracker(SignatureFailures{Ban: true, Threshold: 2, AlertURL: alertServer.URL}, nil)
+	assert.NoError(t, err)
+
+	endpoint := Endpoint{Name: "app", Source: GitLab, KeyPath: "dockerhub_key"}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{}, endpoint, WithFailureTracker(tracker))
+	assert.NoError(t, err)
+
+	send := func(client string) int {
+		req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "gitlab_payload")))
+		req.RemoteAddr = client + ":1234"
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gitlab-Event", "Push Hook")
+		req.Header.Set("X-Gitlab-Token", "forged")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send("192.0.2.1"))
+	assert.Equal(t, http.StatusUnauthorized, send("192.0.2.1"))
+	assert.Equal(t, http.StatusForbidden, send("192.0.2.1"))
+	// other clients aren't affected
+	assert.Equal(t, http.StatusUnauthorized, send("192.0.2.2"))
+
+	tracker.alerts.Wait()
+	select {
+	case ev := <-alerts:
+		assert.Equal(t, eventClientBanned, ev.Event)
+		assert.Equal(t, "high", ev.Severity)
+		assert.Equal(t, "app", ev.Endpoint)
+		assert.Equal(t, "192.0.2.1", ev.Client)
+	default:
+		t.Error("expected an alert to have been sent")
+	}
+}
+
+func Test_SignatureFailuresNoBan(t *testing.T) {
+	proxies, err := parseCIDRs([]string{"10.0.0.0/8"})
+	assert.NoError(t, err)
+
+	send := func(handler http.Handler, remote string, forwardedFor string) int {
+		req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "gitlab_payload")))
+		req.RemoteAddr = remote + ":1234"
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gitlab-Event", "Push Hook")
+		req.Header.Set("X-Gitlab-Token", "forged")
+		rec := httptest.NewRecorder()
+		withClientIP(proxies, handler).ServeHTTP(rec, req)
+		return rec.Code
+	}
+	endpoint := Endpoint{Name: "app", Source: GitLab, KeyPath: "dockerhub_key"}
+
+	// bans are off by default
+	tracker, err := newFailureTracker(SignatureFailures{Threshold: 1}, proxies)
+	assert.NoError(t, err)
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{}, endpoint, WithFailureTracker(tracker))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, send(handler, "192.0.2.1", ""))
+	}
+
+	// with bans on, a trusted proxy, or a client that can't be told,
+	// isn't banned
+	tracker, err = newFailureTracker(SignatureFailures{Ban: true, Threshold: 1}, proxies)
+	assert.NoError(t, err)
+	_, handler, err = HandlerFromEndpoint("test/fixtures", Downstream{}, endpoint, WithFailureTracker(tracker))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, send(handler, "10.0.0.1", ""))
+		assert.Equal(t, http.StatusUnauthorized, send(handler, "10.0.0.1", "_hidden"))
+	}
+	// but a client behind it is
+	assert.Equal(t, http.StatusUnauthorized, send(handler, "10.0.0.1", "192.0.2.1"))
+	assert.Equal(t, http.StatusForbidden, send(handler, "10.0.0.1", "192.0.2.1"))
+	assert.Equal(t, http.StatusUnauthorized, send(handler, "10.0.0.1", ""))
+}
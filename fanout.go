@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// An endpoint can send its changes to more than one Flux API (e.g.,
+// one per tenant). Each change is sent to all of them at once, and
+// fails if it fails for any of them; the result for each is recorded
+// in the delivery.
+
+type target struct {
+	name     string
+	notifier Notifier
+}
+
+// targetResult is what came of sending a change to one downstream.
+type targetResult struct {
+	Target string `json:"target"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+type targetResultKey struct{}
+
+// targetResultFrom returns the result being recorded for the
+// downstream in hand, so the notifier for it can say what it did
+// (e.g., queued the change rather than sending it).
+func targetResultFrom(ctx context.Context) *targetResult {
+	res, _ := ctx.Value(targetResultKey{}).(*targetResult)
+	return res
+}
+
+type fanout []target
+
+// newFanout constructs a notifier that sends changes to all the
+// downstreams given.
+func newFanout(baseDir string, downstreams []Downstream) (fanout, error) {
+	var f fanout
+	for _, d := range downstreams {
+		client, err := d.notifier(baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("downstream %s: %s", d.name(), err.Error())
+		}
+		f = append(f, target{name: d.name(), notifier: client})
+	}
+	return f, nil
+}
+
+// checkDownstreams checks the downstreams given, as newFanout would,
+// but without constructing notifiers for them.
+func checkDownstreams(downstreams []Downstream) error {
+	for _, d := range downstreams {
+		if err := d.check(); err != nil {
+			return fmt.Errorf("downstream %s: %s", d.name(), err.Error())
+		}
+	}
+	return nil
+}
+
+func (f fanout) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	results := make([]targetResult, len(f))
+	errs := make([]error, len(f))
+	var wg sync.WaitGroup
+	for i := range f {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = targetResult{Target: f[i].name}
+			err := f[i].notifier.NotifyChange(context.WithValue(ctx, targetResultKey{}, &results[i]), change)
+			errs[i] = err
+			switch {
+			case err != nil:
+				results[i].Result = resultError
+				results[i].Error = err.Error()
+			case results[i].Result == "":
+				results[i].Result = resultOK
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []string
+	var failedErrs []error
+	var queued bool
+	for i, res := range results {
+		switch res.Result {
+		case resultError:
+			failed = append(failed, res.Target+": "+res.Error)
+			failedErrs = append(failedErrs, errs[i])
+		case resultQueued:
+			queued = true
+		}
+	}
+	if res := changeResultFrom(ctx); res != nil {
+		res.Targets = results
+		if queued && len(failed) == 0 {
+			res.Result = resultQueued
+		}
+	}
+	if len(failed) > 0 {
+		return &fanoutError{
+			msg:  fmt.Sprintf("%d of %d downstreams failed: %s", len(failed), len(f), strings.Join(failed, "; ")),
+			errs: failedErrs,
+		}
+	}
+	return nil
+}
+
+// fanoutError keeps the errors from each downstream that failed, so
+// the response can say how bad it was (see notifyerror.go).
+type fanoutError struct {
+	msg  string
+	errs []error
+}
+
+func (e *fanoutError) Error() string {
+	return e.msg
+}
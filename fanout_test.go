@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Each change should go to every downstream, with its own token, and
+// the result for each should be recorded.
+func Test_Fanout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-fanout")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tenant := func(token string, called *bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Scope-Probe token="+token {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			*called = true
+			fmt.Fprintln(w, `{"status": "OK"}`)
+		}))
+	}
+	var calledA, calledB bool
+	tenantA := tenant("token-a", &calledA)
+	defer tenantA.Close()
+	tenantB := tenant("token-b", &calledB)
+	defer tenantB.Close()
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token-a"), []byte("token-a\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token-b"), []byte("token-b\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "wrong-token"), []byte("wrong\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dockerhub_key"), loadFixture(t, "dockerhub_key"), 0600))
+
+	for _, tt := range []struct {
+		desc    string
+		tokenB  string
+		status  int
+		results []string
+	}{
+		{desc: "all succeed", tokenB: "token-b", status: http.StatusOK, results: []string{resultOK, resultOK}},
+		{desc: "one fails", tokenB: "wrong-token", status: http.StatusBadGateway, results: []string{resultOK, resultError}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			audit, err := openAuditLog(dir, AuditLog{Path: tt.tokenB + ".log"})
+			assert.NoError(t, err)
+
+			endpoint := Endpoint{
+				Source:  GitLab,
+				KeyPath: "dockerhub_key",
+				Downstreams: []Downstream{
+					{URL: tenantA.URL, TokenPath: "token-a"},
+					{URL: tenantB.URL, TokenPath: tt.tokenB},
+				},
+			}
+			// the global API isn't used, since the endpoint has its own
+			_, handler, err := HandlerFromEndpoint(dir, Downstream{URL: "http://127.0.0.1:1"}, endpoint, WithAuditLog(audit))
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "gitlab_payload")))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Gitlab-Event", "Push Hook")
+			req.Header.Set("X-Gitlab-Token", string(loadFixture(t, "dockerhub_key")))
+			rec := httptest.NewRecorder()
+
+			calledA, calledB = false, false
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+			assert.True(t, calledA)
+			assert.Equal(t, tt.results[1] == resultOK, calledB)
+
+			records := readAuditLog(t, filepath.Join(dir, tt.tokenB+".log"))
+			if assert.Len(t, records, 1) && assert.Len(t, records[0].Changes, 1) {
+				targets := records[0].Changes[0].Targets
+				if assert.Len(t, targets, 2) {
+					assert.Equal(t, tenantA.URL, targets[0].Target)
+					assert.Equal(t, tt.results[0], targets[0].Result)
+					assert.Equal(t, tenantB.URL, targets[1].Target)
+					assert.Equal(t, tt.results[1], targets[1].Result)
+				}
+			}
+		})
+	}
+}
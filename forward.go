@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// An endpoint can forward a copy of each request that it handles
+// successfully to other receivers (e.g., CI systems that want the same
+// GitHub events), so only flux-recv need be exposed. The body is sent
+// as it was, with the request headers selected, and optionally signed
+// afresh, with a key for each receiver, in the way GitHub signs hooks.
+//
+// Forwarding happens in the background, once the request has been
+// handled; failures are logged and counted, but not retried. A request
+// that failed (e.g., because the downstream couldn't be reached) isn't
+// forwarded, since the source will retry it, and the retry would be
+// forwarded too.
+
+const defaultSignatureHeader = "X-Hub-Signature-256"
+
+// headers in which sources send signatures or tokens, which are
+// dropped when the request is signed afresh
+var signatureHeaders = []string{
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+	"X-Gitlab-Token",
+	"X-Nexus-Webhook-Signature",
+}
+
+// resultSkipped is for changes not passed on, because the endpoint
+// only forwards requests.
+const resultSkipped = "skipped"
+
+type forwardTarget struct {
+	url             string
+	client          *http.Client
+	headers         []string
+	key             []byte
+	signatureHeader string
+}
+
+type forwarder struct {
+	endpoint string
+	targets  []forwardTarget
+	sending  sync.WaitGroup
+}
+
+func newForwarder(baseDir, endpoint string, forwards []Forward) (*forwarder, error) {
+	f := &forwarder{endpoint: endpoint}
+	for _, fw := range forwards {
+		if fw.URL == "" {
+			return nil, fmt.Errorf("forward: url is required")
+		}
+		client, err := Downstream{CAPath: fw.CAPath, Proxy: fw.Proxy, Timeout: fw.Timeout}.httpClient(baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("forward to %s: %s", fw.URL, err.Error())
+		}
+		t := forwardTarget{
+			url:             fw.URL,
+			client:          client,
+			headers:         fw.Headers,
+			signatureHeader: fw.SignatureHeader,
+		}
+		if fw.KeyPath != "" {
+			key, err := readSecretFile(configPath(baseDir, fw.KeyPath))
+			if err != nil {
+				return nil, fmt.Errorf("forward to %s: cannot load key: %s", fw.URL, err.Error())
+			}
+			t.key = bytes.TrimSpace(key)
+		}
+		if t.signatureHeader == "" {
+			t.signatureHeader = defaultSignatureHeader
+		}
+		f.targets = append(f.targets, t)
+	}
+	return f, nil
+}
+
+// wrap has each request the handler accepts (with 2xx) forwarded.
+func (f *forwarder) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		if r.Body != nil {
+			r.Body = teeBody{ReadCloser: r.Body, r: io.TeeReader(r.Body, &body)}
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if sw.status()/100 != 2 {
+			return
+		}
+		// get the rest of the body, if the handler didn't read it all
+		if r.Body != nil {
+			if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+				log(f.endpoint, "not forwarding request:", err.Error())
+				return
+			}
+		}
+		header := r.Header.Clone()
+		f.sending.Add(1)
+		go func() {
+			defer f.sending.Done()
+			f.send(header, body.Bytes())
+		}()
+	})
+}
+
+type teeBody struct {
+	io.ReadCloser
+	r io.Reader
+}
+
+func (b teeBody) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (f *forwarder) send(header http.Header, body []byte) {
+	var wg sync.WaitGroup
+	for _, t := range f.targets {
+		wg.Add(1)
+		go func(t forwardTarget) {
+			defer wg.Done()
+			result := resultOK
+			if err := t.send(header, body); err != nil {
+				result = resultError
+				log(f.endpoint, "could not forward request to", t.url+":", err.Error())
+			}
+			forwardsMetric.WithLabelValues(f.endpoint, result).Inc()
+		}(t)
+	}
+	wg.Wait()
+}
+
+func (t forwardTarget) send(header http.Header, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	t.copyHeaders(req.Header, header)
+	if t.key != nil {
+		for _, h := range signatureHeaders {
+			req.Header.Del(h)
+		}
+		mac := hmac.New(sha256.New, t.key)
+		mac.Write(body)
+		req.Header.Set(t.signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("responded %s", resp.Status)
+	}
+	return nil
+}
+
+// copyHeaders copies the headers selected for the target; or if none
+// were, Content-Type, User-Agent, and those starting with X- (which is
+// where sources put the event type, delivery ID, and so on), other
+// than those added by proxies.
+func (t forwardTarget) copyHeaders(dst, src http.Header) {
+	if len(t.headers) > 0 {
+		for _, h := range t.headers {
+			for _, v := range src[http.CanonicalHeaderKey(h)] {
+				dst.Add(h, v)
+			}
+		}
+		return
+	}
+	for h, vs := range src {
+		switch {
+		case h == "Content-Type", h == "User-Agent":
+		case strings.HasPrefix(h, "X-Forwarded-"), h == "X-Real-Ip":
+			continue
+		case !strings.HasPrefix(h, "X-"):
+			continue
+		}
+		for _, v := range vs {
+			dst.Add(h, v)
+		}
+	}
+}
+
+// skipNotifier is used in place of the downstreams for endpoints that
+// only forward requests.
+type skipNotifier struct{}
+
+func (skipNotifier) NotifyChange(ctx context.Context, _ fluxapi_v9.Change) error {
+	if res := changeResultFrom(ctx); res != nil {
+		res.Result = resultSkipped
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type forwardReceiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (f *forwardReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, body)
+	f.mu.Unlock()
+}
+
+func (f *forwardReceiver) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+// sendTrimmedGitlabPush is like sendGitlabPush, but with a token that
+// can go in a header when forwarded (i.e., without the newline).
+func sendTrimmedGitlabPush(t *testing.T, handler http.Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "gitlab_payload")))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gitlab-Event", "Push Hook")
+	req.Header.Set("X-Gitlab-Token", string(bytes.TrimSpace(loadFixture(t, "dockerhub_key"))))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestForward(t *testing.T) {
+	receiver := &forwardReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	downstream := httptest.NewServer(&flakyDownstream{})
+	defer downstream.Close()
+
+	endpoint := Endpoint{
+		Source:  GitLab,
+		KeyPath: "dockerhub_key",
+		KeyTrim: true,
+		Forward: []Forward{
+			{URL: server.URL},
+			{URL: server.URL, KeyPath: "github_key", Headers: []string{"Content-Type"}},
+		},
+	}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
+	assert.NoError(t, err)
+
+	rec := sendTrimmedGitlabPush(t, handler)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	eventually(t, func() bool { return receiver.count() == 2 })
+
+	payload := loadFixture(t, "gitlab_payload")
+	mac := hmac.New(sha256.New, bytes.TrimSpace(loadFixture(t, "github_key")))
+	mac.Write(payload)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	for i, r := range receiver.requests {
+		assert.Equal(t, payload, receiver.bodies[i])
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		if r.Header.Get("X-Hub-Signature-256") != "" {
+			// signed afresh, with only the headers selected
+			assert.Equal(t, signature, r.Header.Get("X-Hub-Signature-256"))
+			assert.Empty(t, r.Header.Get("X-Gitlab-Token"))
+			assert.Empty(t, r.Header.Get("X-Gitlab-Event"))
+		} else {
+			assert.Equal(t, "Push Hook", r.Header.Get("X-Gitlab-Event"))
+			assert.NotEmpty(t, r.Header.Get("X-Gitlab-Token"))
+		}
+	}
+}
+
+func TestForwardNotVerified(t *testing.T) {
+	receiver := &forwardReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	// the wrong key, so verification fails
+	endpoint := Endpoint{Source: GitLab, KeyPath: "github_key", Forward: []Forward{{URL: server.URL}}}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{}, endpoint)
+	assert.NoError(t, err)
+	rec := sendTrimmedGitlabPush(t, handler)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// then a good request, to an endpoint that only forwards; if the
+	// bad one had been forwarded too, there'd be two
+	endpoint = Endpoint{Source: GitLab, KeyPath: "dockerhub_key", KeyTrim: true, Forward: []Forward{{URL: server.URL}}, ForwardOnly: true}
+	_, handler, err = HandlerFromEndpoint("test/fixtures", Downstream{}, endpoint)
+	assert.NoError(t, err)
+	rec = sendTrimmedGitlabPush(t, handler)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	eventually(t, func() bool { return receiver.count() == 1 })
+}
+
+// A request that's verified but fails, because the downstream is down,
+// isn't forwarded; the source will retry it, and the retry would be
+// forwarded too.
+func TestForwardNotFailed(t *testing.T) {
+	receiver := &forwardReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	downstream := &flakyDownstream{failures: 1}
+	downstreamServer := httptest.NewServer(downstream)
+	defer downstreamServer.Close()
+
+	endpoint := Endpoint{Source: GitLab, KeyPath: "dockerhub_key", KeyTrim: true, Forward: []Forward{{URL: server.URL}}}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstreamServer.URL}, endpoint)
+	assert.NoError(t, err)
+	rec := sendTrimmedGitlabPush(t, handler)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+
+	// the retry succeeds, and is forwarded; if the failed request
+	// had been forwarded too, there'd be two
+	rec = sendTrimmedGitlabPush(t, handler)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	eventually(t, func() bool { return receiver.count() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, receiver.count())
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
 
-	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"github.com/fluxcd/flux/pkg/image"
 )
 
 const GoogleContainerRegistry = "GoogleContainerRegistry"
@@ -30,69 +34,117 @@ type payload struct {
 	} `json:"message"`
 }
 
-type auth struct {
-	Aud string `json:"aud"`
-}
-
 func init() {
 	Sources[GoogleContainerRegistry] = handleGoogleContainerRegistry
+	downstreamStatuses[GoogleContainerRegistry] = pubSubStatus
+}
+
+// Pub/Sub redelivers a message whenever it gets anything other than a
+// 2xx, until the message is days old, with its own backoff (paying no
+// attention to Retry-After). So: messages that can't be acted on,
+// whether because they are malformed, or because the downstream
+// refused the change (with a 4xx), are acknowledged, and dead-lettered
+// (see deadletter.go); and those that might succeed later (the
+// downstream was unavailable, timed out, or answered with a 5xx or 429
+// Too Many Requests) are refused with 503, to be redelivered.
+
+func pubSubStatus(error) int {
+	return http.StatusServiceUnavailable
+}
+
+// permanentError is a failure that redelivering the message won't fix.
+type permanentError struct {
+	reason string
+}
+
+func (e permanentError) Error() string {
+	return e.reason
 }
 
-func handleGoogleContainerRegistry(s fluxapi.Server, _ []byte, w http.ResponseWriter, r *http.Request, config Endpoint) {
+func handleGoogleContainerRegistry(s Notifier, _ []byte, w http.ResponseWriter, r *http.Request, config Endpoint) {
 	// authenticate based on config
 	if config.GCR != nil {
-		if err := authenticateRequest(&http.Client{}, r.Header.Get("Authorization"), config.GCR.Audience); err != nil {
-			http.Error(w, "Cannot authorize request", http.StatusOK)
+		if err := authenticateRequest(r.Context(), r.Header.Get("Authorization"), *config.GCR); err != nil {
+			http.Error(w, "Cannot authorize request", http.StatusUnauthorized)
 			log(GoogleContainerRegistry, err.Error())
 			return
 		}
+		markVerified(r)
 	}
 
-	var p payload
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-		http.Error(w, "Cannot decode payload", http.StatusOK)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Cannot read payload", http.StatusBadRequest)
 		log(GoogleContainerRegistry, err.Error())
 		return
 	}
+	var p payload
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&p); err != nil {
+		ackDeadLetter(w, r, GoogleContainerRegistry, body, "", "cannot decode payload: "+err.Error())
+		return
+	}
 
-	raw, _ := base64.StdEncoding.DecodeString(p.Message.Data)
+	setDeliveryID(r, p.Message.MessageID)
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	switch err := passOnGCRMessage(ctx, s, p).(type) {
+	case nil:
+		respond(w, r, http.StatusOK, "")
+	case permanentError:
+		ackDeadLetter(w, r, GoogleContainerRegistry, body, p.Message.MessageID, err.reason)
+	default:
+		notifyFailed(w, r, GoogleContainerRegistry, err)
+	}
+}
 
+// passOnGCRMessage passes on the change in the message, if it's for an
+// image being pushed. Failures that retrying won't fix are returned as
+// permanentError.
+func passOnGCRMessage(ctx context.Context, s Notifier, p payload) error {
+	raw, err := base64.StdEncoding.DecodeString(p.Message.Data)
+	if err != nil {
+		return permanentError{"cannot decode message data: " + err.Error()}
+	}
 	var d data
-	json.Unmarshal(raw, &d)
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return permanentError{"cannot decode message data: " + err.Error()}
+	}
 
+	setEvent(ctx, d.Action)
 	if strings.ToLower(d.Action) != insert {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("action is not an insert, moving on"))
-		return
+		recordSkipped(ctx, d.Tag, "action is not "+insert)
+		return nil
 	}
 
 	log(GoogleContainerRegistry, fmt.Sprintf("Update: %s", d.Tag))
 
-	doImageNotify(s, w, r, d.Tag)
-}
-
-func authenticateRequest(c *http.Client, bearer string, audience string) (err error) {
-	if len(bearer) < tokenIndex {
-		return fmt.Errorf("Authorization header is missing or malformed: %v", bearer)
-	}
-
-	token := bearer[tokenIndex:]
-	url := fmt.Sprintf("https://oauth2.googleapis.com/tokeninfo?id_token=%s", token)
-
-	resp, err := c.Get(url)
+	ref, err := image.ParseRef(d.Tag)
 	if err != nil {
-		return fmt.Errorf("Cannot verify authenticity of payload: %w", err)
+		return permanentError{"cannot parse image: " + err.Error()}
+	}
+	err = s.NotifyChange(ctx, fluxapi_v9.Change{
+		Kind:   fluxapi_v9.ImageChange,
+		Source: fluxapi_v9.ImageUpdate{Name: ref.Name},
+	})
+	if err != nil && refusedPermanently(err) {
+		return permanentError{"downstream refused change: " + err.Error()}
 	}
+	return err
+}
 
-	var p auth
-	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
-		return fmt.Errorf("Cannot decode auth payload: %w", err)
+func authenticateRequest(ctx context.Context, bearer string, expect GCRAuth) error {
+	if len(bearer) < tokenIndex || !strings.EqualFold(bearer[:tokenIndex], "Bearer ") {
+		return fmt.Errorf("Authorization header is missing or malformed")
 	}
 
-	// check if we are the intended audience
-	if p.Aud != audience {
-		return fmt.Errorf("Payload received but intended for a different audience: %v", p.Aud)
+	jwksURL := expect.JWKSURL
+	if jwksURL == "" {
+		jwksURL = defaultGoogleJWKSURL
 	}
 
+	if _, err := verifyIDToken(ctx, keySetFor(jwksURL), bearer[tokenIndex:], expect, time.Now()); err != nil {
+		return fmt.Errorf("Cannot verify authenticity of payload: %w", err)
+	}
 	return nil
 }
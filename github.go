@@ -8,7 +8,6 @@ import (
 
 	"github.com/google/go-github/v28/github"
 
-	fluxapi "github.com/fluxcd/flux/pkg/api"
 	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
 )
 
@@ -16,15 +15,18 @@ const GitHub = "GitHub"
 
 func init() {
 	Sources[GitHub] = handleGithubPush
+	contentTypes[GitHub] = []string{"application/json", "application/x-www-form-urlencoded"}
+	deliveryIDHeaders[GitHub] = "X-GitHub-Delivery"
 }
 
-func handleGithubPush(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
+func handleGithubPush(s Notifier, key []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
 	payload, err := github.ValidatePayload(r, key)
 	if err != nil {
 		http.Error(w, "The GitHub signature header is invalid.", 401)
 		log(GitHub, "invalid signature:", err.Error())
 		return
 	}
+	markVerified(r)
 
 	hook, err := github.ParseWebHook(github.WebHookType(r), payload)
 	if err != nil {
@@ -33,10 +35,10 @@ func handleGithubPush(s fluxapi.Server, key []byte, w http.ResponseWriter, r *ht
 		return
 	}
 
+	setEvent(r.Context(), github.WebHookType(r))
 	switch hook := hook.(type) {
 	case *github.PingEvent:
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Pong"))
+		respond(w, r, http.StatusOK, "Pong")
 	case *github.PushEvent:
 		update := fluxapi_v9.GitUpdate{
 			URL:    *hook.Repo.SSHURL,
@@ -50,23 +52,14 @@ func handleGithubPush(s fluxapi.Server, key []byte, w http.ResponseWriter, r *ht
 		ctx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
-		err := s.NotifyChange(ctx, change)
-		if err != nil {
-			select {
-			case <-ctx.Done():
-				http.Error(w, "Timed out waiting for response from downstream API", http.StatusRequestTimeout)
-				log(GitHub, "timed out")
-			default:
-				http.Error(w, "Error while calling downstream API", http.StatusInternalServerError)
-				log(GitHub, "error:", err.Error())
-			}
+		if err := s.NotifyChange(ctx, change); err != nil {
+			notifyFailed(w, r, GitHub, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
+		respond(w, r, http.StatusOK, "OK")
 	default:
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("unexpected hook kind, but OK"))
+		recordSkipped(r.Context(), "", "not a push event")
+		respond(w, r, http.StatusOK, "unexpected hook kind, but OK")
 		log(GitHub, "unexpected webhook payload", fmt.Sprintf("received webhook: %T\n%s", hook, github.Stringify(hook)))
 	}
 }
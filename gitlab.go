@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"strings"
 
-	fluxapi "github.com/fluxcd/flux/pkg/api"
 	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
 )
 
@@ -14,19 +13,22 @@ const GitLab = "GitLab"
 
 func init() {
 	Sources[GitLab] = handleGitlabPush
+	deliveryIDHeaders[GitLab] = "X-Gitlab-Event-UUID"
 }
 
-func handleGitlabPush(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
+func handleGitlabPush(s Notifier, key []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
 	if r.Header.Get("X-Gitlab-Token") != string(key) {
 		http.Error(w, "The Gitlab token does not match", http.StatusUnauthorized)
 		log(GitLab, "missing or incorrect X-Gitlab-Token header (!= shared secret)")
 		return
 	}
+	markVerified(r)
 	if event := r.Header.Get("X-Gitlab-Event"); event != "Push Hook" {
 		http.Error(w, "Unexpected or missing X-Gitlab-Event", http.StatusBadRequest)
 		log(GitLab, "unknown gitlab event header:", event)
 		return
 	}
+	setEvent(r.Context(), "Push Hook")
 
 	type gitlabPayload struct {
 		Ref     string
@@ -53,11 +55,9 @@ func handleGitlabPush(s fluxapi.Server, key []byte, w http.ResponseWriter, r *ht
 	ctx, cancel := context.WithTimeout(r.Context(), timeout)
 	defer cancel()
 	if err := s.NotifyChange(ctx, change); err != nil {
-		http.Error(w, "Error forwarding hook", http.StatusInternalServerError)
-		log(GitLab, "error from downstream:", err.Error())
+		notifyFailed(w, r, GitLab, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	respond(w, r, http.StatusOK, "OK")
 }
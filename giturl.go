@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// fluxd ignores a notification unless its git URL is byte for byte
+// the same as the one fluxd was given with --git-url; but each source
+// has its own idea of the URL for a repo (GitHub and GitLab send the
+// scp-like ssh form, Bitbucket Server an ssh:// URL). So that
+// notifications match, an endpoint can rewrite the URLs of git
+// changes: to another form, to another host (e.g., a mirror), with a
+// template, or with regular expressions; in that order.
+
+const (
+	gitURLFormSSH    = "ssh"     // git@github.com:owner/repo.git
+	gitURLFormSSHURL = "ssh-url" // ssh://git@github.com/owner/repo.git
+	gitURLFormHTTPS  = "https"   // https://github.com/owner/repo.git
+)
+
+// gitURLParts are the parts of a git URL that can be rewritten.
+type gitURLParts struct {
+	// the original URL
+	URL string
+	// the user for ssh, if one was given
+	User string
+	// the host, including the port if one was given
+	Host string
+	// the path, without a leading slash, e.g., owner/repo.git
+	Path string
+	// the scheme, or "" if it's the scp-like form
+	scheme string
+	// whether the host has a port for ssh
+	sshPort bool
+}
+
+// parseGitURL splits a git URL into parts, whether it's a URL (e.g.,
+// https://github.com/owner/repo.git) or scp-like
+// (git@github.com:owner/repo.git).
+func parseGitURL(s string) (gitURLParts, error) {
+	parts := gitURLParts{URL: s}
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" && u.Host != "" {
+		parts.scheme = u.Scheme
+		if u.User != nil {
+			parts.User = u.User.Username()
+		}
+		parts.Host = u.Host
+		parts.sshPort = u.Scheme == "ssh" && u.Port() != ""
+		parts.Path = strings.TrimPrefix(u.Path, "/")
+		return parts, nil
+	}
+	i := strings.Index(s, ":")
+	if i <= 0 || strings.Contains(s[:i], "/") {
+		return parts, fmt.Errorf("not a git URL: %q", s)
+	}
+	host := s[:i]
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		parts.User = host[:at]
+		host = host[at+1:]
+	}
+	parts.Host = host
+	parts.Path = strings.TrimPrefix(s[i+1:], "/")
+	return parts, nil
+}
+
+func (p gitURLParts) sshUser() string {
+	if p.User != "" {
+		return p.User
+	}
+	return "git"
+}
+
+// format puts the URL in the form given, or if none is given, the form
+// it was in. The scp-like form can't have a port, so a URL with one
+// gets the ssh:// form instead.
+func (p gitURLParts) format(form string) string {
+	if form == "" {
+		if p.scheme != "" {
+			user := ""
+			if p.User != "" {
+				user = p.User + "@"
+			}
+			return p.scheme + "://" + user + p.Host + "/" + p.Path
+		}
+		form = gitURLFormSSH
+	}
+	switch form {
+	case gitURLFormSSH:
+		if _, _, err := net.SplitHostPort(p.Host); err != nil {
+			return p.sshUser() + "@" + p.Host + ":" + p.Path
+		}
+		fallthrough
+	case gitURLFormSSHURL:
+		return "ssh://" + p.sshUser() + "@" + p.Host + "/" + p.Path
+	case gitURLFormHTTPS:
+		host := p.Host
+		if p.sshPort {
+			// a port for ssh is no use for https
+			host, _, _ = net.SplitHostPort(host)
+		}
+		return "https://" + host + "/" + p.Path
+	}
+	return p.URL
+}
+
+type gitURLRewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// gitURLRewriter rewrites the URLs of git changes before passing them
+// on.
+type gitURLRewriter struct {
+	form     string
+	host     string
+	template *template.Template
+	rewrites []gitURLRewrite
+	next     Notifier
+}
+
+func newGitURLRewriter(conf GitURL, next Notifier) (*gitURLRewriter, error) {
+	r := &gitURLRewriter{form: conf.Form, host: conf.Host, next: next}
+	switch conf.Form {
+	case "", gitURLFormSSH, gitURLFormSSHURL, gitURLFormHTTPS:
+	default:
+		return nil, fmt.Errorf("gitURL: unknown form %q; expected %q, %q, or %q", conf.Form, gitURLFormSSH, gitURLFormSSHURL, gitURLFormHTTPS)
+	}
+	if conf.Template != "" {
+		if conf.Form != "" {
+			return nil, fmt.Errorf("gitURL: give either a form or a template, not both")
+		}
+		tmpl, err := template.New("gitURL").Option("missingkey=error").Parse(conf.Template)
+		if err != nil {
+			return nil, fmt.Errorf("gitURL: template: %s", err.Error())
+		}
+		r.template = tmpl
+	}
+	for i, rw := range conf.Rewrite {
+		re, err := regexp.Compile(rw.Match)
+		if err != nil {
+			return nil, fmt.Errorf("gitURL: rewrite %d: %s", i+1, err.Error())
+		}
+		r.rewrites = append(r.rewrites, gitURLRewrite{match: re, replace: rw.Replace})
+	}
+	return r, nil
+}
+
+// rewrite returns the URL rewritten.
+func (r *gitURLRewriter) rewrite(s string) (string, error) {
+	if r.form != "" || r.host != "" || r.template != nil {
+		parts, err := parseGitURL(s)
+		if err != nil {
+			return "", err
+		}
+		if r.host != "" {
+			parts.Host, parts.sshPort = r.host, false
+		}
+		if r.template != nil {
+			var buf bytes.Buffer
+			if err := r.template.Execute(&buf, parts); err != nil {
+				return "", err
+			}
+			s = buf.String()
+		} else {
+			s = parts.format(r.form)
+		}
+	}
+	for _, rw := range r.rewrites {
+		s = rw.match.ReplaceAllString(s, rw.replace)
+	}
+	return s, nil
+}
+
+func (r *gitURLRewriter) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	if update, ok := change.Source.(fluxapi_v9.GitUpdate); ok {
+		rewritten, err := r.rewrite(update.URL)
+		if err != nil {
+			// better to pass it on as it is, than not at all
+			log("cannot rewrite git URL", update.URL+":", err.Error())
+		} else {
+			update.URL = rewritten
+			change.Source = update
+		}
+	}
+	return r.next.NotifyChange(ctx, change)
+}
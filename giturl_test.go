@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitURLRewrite(t *testing.T) {
+	for _, tt := range []struct {
+		desc     string
+		conf     GitURL
+		url      string
+		expected string
+	}{
+		{"https from scp-like", GitURL{Form: "https"}, "git@github.com:owner/repo.git", "https://github.com/owner/repo.git"},
+		{"ssh:// from scp-like", GitURL{Form: "ssh-url"}, "git@github.com:owner/repo.git", "ssh://git@github.com/owner/repo.git"},
+		{"scp-like from ssh://", GitURL{Form: "ssh"}, "ssh://git@bitbucket.example.com/~me/repo.git", "git@bitbucket.example.com:~me/repo.git"},
+		{"scp-like can't have a port", GitURL{Form: "ssh"}, "ssh://git@bitbucket.example.com:7999/proj/repo.git", "ssh://git@bitbucket.example.com:7999/proj/repo.git"},
+		{"https drops ssh port", GitURL{Form: "https"}, "ssh://git@bitbucket.example.com:7999/proj/repo.git", "https://bitbucket.example.com/proj/repo.git"},
+		{"mirror, same form", GitURL{Host: "mirror.example.com"}, "git@github.com:owner/repo.git", "git@mirror.example.com:owner/repo.git"},
+		{"mirror over https", GitURL{Form: "https", Host: "mirror.example.com:8443"}, "git@github.com:owner/repo.git", "https://mirror.example.com:8443/owner/repo.git"},
+		{"template", GitURL{Template: "https://{{.Host}}/git/{{.Path}}"}, "git@gitlab.com:group/repo.git", "https://gitlab.com/git/group/repo.git"},
+		{"regexp", GitURL{Rewrite: []GitURLRewrite{{Match: `\.git$`, Replace: ""}, {Match: `^git@([^:]+):`, Replace: "https://$1/"}}}, "git@github.com:owner/repo.git", "https://github.com/owner/repo"},
+		{"form, then regexp", GitURL{Form: "https", Rewrite: []GitURLRewrite{{Match: `^https://github\.com/`, Replace: "https://mirror/github/"}}}, "git@github.com:owner/repo.git", "https://mirror/github/owner/repo.git"},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			r, err := newGitURLRewriter(tt.conf, nil)
+			assert.NoError(t, err)
+			rewritten, err := r.rewrite(tt.url)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, rewritten)
+		})
+	}
+
+	for _, conf := range []GitURL{
+		{Form: "scp"},
+		{Form: "https", Template: "{{.URL}}"},
+		{Template: "{{.URL"},
+		{Rewrite: []GitURLRewrite{{Match: "("}}},
+	} {
+		_, err := newGitURLRewriter(conf, nil)
+		assert.Error(t, err)
+	}
+}
+
+func TestGitURLRewriteEndpoint(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, `{"Kind":"git","Source":{"URL":"https://mirror.example.com/mike/diaspora.git","Branch":"master"}}`, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{
+		Source:  GitLab,
+		KeyPath: "dockerhub_key",
+		GitURL:  &GitURL{Form: "https", Host: "mirror.example.com"},
+	}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
+	assert.NoError(t, err)
+	rec := sendGitlabPush(t, handler)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, called)
+
+	// Bitbucket makes the records of its changes before they're
+	// passed on; they should still have the URL as rewritten, so it
+	// can be checked in the response, e.g., in a dry run
+	const mirrored = "https://mirror.example.com/mbridgen/dummy.git"
+	downstream = newDownstream(t, `{"Kind":"git","Source":{"URL":"`+mirrored+`","Branch":"master"}}`, &called)
+	defer downstream.Close()
+	endpoint = Endpoint{
+		Source:  BitbucketCloud,
+		KeyPath: "bitbucket_cloud_key",
+		GitURL:  &GitURL{Form: "https", Host: "mirror.example.com"},
+	}
+	for _, dryRun := range []bool{false, true} {
+		called = false
+		endpoint.DryRun = dryRun
+		_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
+		assert.NoError(t, err)
+		req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "bitbucket_cloud_payload")))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Event-Key", "repo:push")
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, !dryRun, called)
+		var resp deliveryResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		if assert.Len(t, resp.Changes, 1) {
+			assert.Equal(t, mirrored, resp.Changes[0].URL)
+		}
+	}
+}
@@ -3,12 +3,16 @@ module github.com/fluxcd/flux-recv
 go 1.13
 
 require (
+	filippo.io/age v1.2.0
 	github.com/fluxcd/flux v1.15.0
 	github.com/ghodss/yaml v1.0.0
 	github.com/google/go-github/v28 v28.1.1
+	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.1.0
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/sync v0.0.0-20190227155943-e225da77a7e6
+	golang.org/x/crypto v0.24.0
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 	gopkg.in/yaml.v2 v2.2.5 // indirect
 )
 
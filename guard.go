@@ -0,0 +1,74 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+)
+
+// Before a request gets anywhere near a source handler, check that
+// it's the kind of request a webhook would be: a POST, with a body
+// of the type the source sends, and not too big. (The exception is a
+// GET of an endpoint that lists its dead letters; see deadletter.go.)
+
+const defaultMaxBodyBytes = 1 << 20
+
+// contentTypes lists the media types each source may send, if not
+// just "application/json".
+var contentTypes = map[string][]string{}
+
+var defaultContentTypes = []string{"application/json"}
+
+func acceptsContentType(source, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	accepted, ok := contentTypes[source]
+	if !ok {
+		accepted = defaultContentTypes
+	}
+	for _, t := range accepted {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// maxBodyBytes is the largest request body the endpoint accepts.
+func (ep Endpoint) maxBodyBytes() int64 {
+	if ep.MaxBodyBytes <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return ep.MaxBodyBytes
+}
+
+func guardRequest(ep Endpoint, next http.Handler) http.Handler {
+	maxBytes := ep.maxBodyBytes()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && ep.DeadLetter != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); !acceptsContentType(ep.Source, ct) {
+			http.Error(w, "Unsupported Content-Type", http.StatusUnsupportedMediaType)
+			log(ep.Source, "unsupported Content-Type:", ct)
+			return
+		}
+		if r.ContentLength > maxBytes {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			log(ep.Source, "request body too large:", r.ContentLength, "bytes")
+			return
+		}
+		// this catches bodies that don't declare their length up
+		// front; the source handler will fail to read the payload
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		next.ServeHTTP(w, r)
+	})
+}
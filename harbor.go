@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-
-	fluxapi "github.com/fluxcd/flux/pkg/api"
 )
 
 const Harbor = "Harbor"
@@ -13,12 +11,13 @@ func init() {
 	Sources[Harbor] = handleHarbor
 }
 
-func handleHarbor(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
+func handleHarbor(s Notifier, key []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
 	if r.Header.Get("Authorization") != string(key) {
 		http.Error(w, "The Harbor token does not match", http.StatusUnauthorized)
 		log(Harbor, "missing or incorrect Authorization header (!= shared secret)")
 		return
 	}
+	markVerified(r)
 
 	type payload struct {
 		Type string `json:"type"`
@@ -36,8 +35,14 @@ func handleHarbor(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.R
 		return
 	}
 
+	setEvent(r.Context(), p.Type)
 	if p.Type != "pushImage" && p.Type != "PUSH_ARTIFACT" {
-		http.Error(w, "Unexpected event type", http.StatusBadRequest)
+		var what string
+		if len(p.EventData.Resources) > 0 {
+			what = p.EventData.Resources[0].ResourceURL
+		}
+		recordSkipped(r.Context(), what, "event type is not pushImage or PUSH_ARTIFACT")
+		respond(w, r, http.StatusBadRequest, "Unexpected event type\n")
 		log(Harbor, "unexpected event type:", p.Type)
 		return
 	}
@@ -47,5 +52,5 @@ func handleHarbor(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.R
 	// only need to notify Flux once. For sake of simplicity we
 	// pick the first one.
 	res := p.EventData.Resources[0]
-	doImageNotify(s, w, r, res.ResourceURL)
+	doImageNotify(s, w, r, Harbor, res.ResourceURL)
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"unicode"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Keys shorter than this are easy to guess, and since the key also
+// determines the URL of the endpoint, that matters even for sources
+// that don't use the key to verify payloads. (GitHub recommends 20
+// random bytes, hex-encoded; so 40 bytes.)
+const minKeyLength = 16
+
+// The master key is the root of all the derived keys, so it must be
+// long enough not to be guessed.
+const minMasterKeyLength = 32
+
+// Derived keys are 20 bytes, hex-encoded (as GitHub recommends); the
+// hex-encoded string is the key, since that's what gets pasted into
+// the provider's webhook settings.
+const (
+	derivedKeyLength = 20
+	derivedKeyInfo   = "flux-recv endpoint key "
+)
+
+const (
+	keyEncodingBase64 = "base64"
+	keyEncodingHex    = "hex"
+)
+
+// keyFile returns the path of the file containing the endpoint's key,
+// if it has one.
+func (ep Endpoint) keyFile() string {
+	if ep.KeyFile != "" {
+		return ep.KeyFile
+	}
+	return ep.KeyPath
+}
+
+// hasOwnKey says whether the endpoint is given a key, rather than
+// having one derived from the master key.
+func (ep Endpoint) hasOwnKey() bool {
+	return ep.keyFile() != "" || ep.KeyEnv != ""
+}
+
+// keyDescription says where the endpoint's key comes from, for
+// logging.
+func (ep Endpoint) keyDescription(baseDir string) string {
+	if !ep.hasOwnKey() && ep.Name != "" {
+		return "derived from the master key for " + ep.Name
+	}
+	if ep.KeyEnv != "" {
+		return "from environment variable " + ep.KeyEnv
+	}
+	return filepath.Join(baseDir, ep.keyFile())
+}
+
+// loadKey loads the key for an endpoint, from a file or the
+// environment, and trims and decodes it if asked to.
+func loadKey(baseDir string, ep Endpoint) ([]byte, error) {
+	given := 0
+	for _, s := range []string{ep.KeyPath, ep.KeyFile, ep.KeyEnv} {
+		if s != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return nil, fmt.Errorf("give only one of keyPath, keyFile, or keyEnv")
+	}
+
+	var key []byte
+	switch {
+	case ep.KeyEnv != "":
+		val, ok := os.LookupEnv(ep.KeyEnv)
+		if !ok {
+			return nil, fmt.Errorf("cannot load key: environment variable %s is not set", ep.KeyEnv)
+		}
+		key = []byte(val)
+	case ep.keyFile() != "":
+		bytes, err := readSecretFile(filepath.Join(baseDir, ep.keyFile()))
+		if err != nil {
+			return nil, fmt.Errorf("cannot load key from %q: %s", ep.keyFile(), err.Error())
+		}
+		key = bytes
+	default:
+		return nil, fmt.Errorf("no key given; use keyPath, keyFile, or keyEnv")
+	}
+
+	if ep.KeyTrim || ep.KeyEncoding != "" {
+		key = bytes.TrimSpace(key)
+	} else if len(key) > 0 && unicode.IsSpace(rune(key[len(key)-1])) {
+		// This is almost always a mistake (e.g., an editor adding a
+		// newline), but it's not certain; so, warn rather than
+		// refuse.
+		log("warning: key", ep.keyDescription(baseDir), "ends with whitespace, which will be treated as part of the key; use keyTrim: true to remove it")
+	}
+
+	switch ep.KeyEncoding {
+	case "":
+	case keyEncodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(string(key))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode key as base64: %s", err.Error())
+		}
+		key = decoded
+	case keyEncodingHex:
+		decoded, err := hex.DecodeString(string(key))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode key as hex: %s", err.Error())
+		}
+		key = decoded
+	default:
+		return nil, fmt.Errorf("unknown keyEncoding %q; use %q or %q", ep.KeyEncoding, keyEncodingBase64, keyEncodingHex)
+	}
+
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key %s is empty", ep.keyDescription(baseDir))
+	}
+	if len(key) < minKeyLength {
+		log("warning: key", ep.keyDescription(baseDir), "is only", len(key), "bytes long; it should be at least", minKeyLength)
+	}
+	return key, nil
+}
+
+// loadMasterKey loads the master key, from a file or the environment.
+func loadMasterKey(baseDir string, mk MasterKey) ([]byte, error) {
+	key, err := loadKey(baseDir, Endpoint{KeyPath: mk.Path, KeyEnv: mk.Env, KeyEncoding: mk.Encoding, KeyTrim: true})
+	if err != nil {
+		return nil, fmt.Errorf("masterKey: %s", err.Error())
+	}
+	if len(key) < minMasterKeyLength {
+		return nil, fmt.Errorf("masterKey: must be at least %d bytes long", minMasterKeyLength)
+	}
+	return key, nil
+}
+
+// deriveKey derives the key for the endpoint with the name given from
+// the master key, using HKDF.
+func deriveKey(master []byte, name string) []byte {
+	key := make([]byte, derivedKeyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte(derivedKeyInfo+name)), key); err != nil {
+		panic(err) // only possible if asking for too much
+	}
+	return []byte(hex.EncodeToString(key))
+}
+
+// endpointKey returns the key for an endpoint: its own, if it has one,
+// otherwise one derived from the master key.
+func endpointKey(baseDir string, ep Endpoint, master []byte) ([]byte, error) {
+	if ep.hasOwnKey() || master == nil {
+		return loadKey(baseDir, ep)
+	}
+	if ep.Name == "" {
+		return nil, fmt.Errorf("endpoint needs a name to derive its key from the master key")
+	}
+	return deriveKey(master, ep.Name), nil
+}
+
+// endpointDigest is the digest of the endpoint's key and registry
+// host, by which requests are routed to it.
+func endpointDigest(key []byte, ep Endpoint) string {
+	sha := sha256.New()
+	sha.Write(key)
+	sha.Write([]byte(ep.RegistryHost))
+	return fmt.Sprintf("%x", sha.Sum(nil))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadKey(t *testing.T) {
+	os.Setenv("FLUXRECV_TEST_KEY", "  0123456789abcdef0123456789abcdef01234567\n")
+	os.Setenv("FLUXRECV_TEST_KEY_BASE64", "c2VjcmV0LXNlY3JldC1zZWNyZXQ=\n")
+	defer os.Unsetenv("FLUXRECV_TEST_KEY")
+	defer os.Unsetenv("FLUXRECV_TEST_KEY_BASE64")
+
+	for _, tt := range []struct {
+		desc     string
+		endpoint Endpoint
+		expected string
+	}{
+		{
+			desc:     "file, as-is",
+			endpoint: Endpoint{KeyPath: "github_key"},
+			expected: "423be8373b98a9ffccc10402cc033e77263e1cdf\n",
+		},
+		{
+			desc:     "file, trimmed",
+			endpoint: Endpoint{KeyFile: "github_key", KeyTrim: true},
+			expected: "423be8373b98a9ffccc10402cc033e77263e1cdf",
+		},
+		{
+			desc:     "environment, trimmed",
+			endpoint: Endpoint{KeyEnv: "FLUXRECV_TEST_KEY", KeyTrim: true},
+			expected: "0123456789abcdef0123456789abcdef01234567",
+		},
+		{
+			desc:     "environment, base64",
+			endpoint: Endpoint{KeyEnv: "FLUXRECV_TEST_KEY_BASE64", KeyEncoding: "base64"},
+			expected: "secret-secret-secret",
+		},
+		{
+			desc:     "file, hex",
+			endpoint: Endpoint{KeyPath: "github_key", KeyEncoding: "hex"},
+			expected: "\x42\x3b\xe8\x37\x3b\x98\xa9\xff\xcc\xc1\x04\x02\xcc\x03\x3e\x77\x26\x3e\x1c\xdf",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			key, err := loadKey("test/fixtures", tt.endpoint)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, string(key))
+		})
+	}
+}
+
+func TestBadKeys(t *testing.T) {
+	for name, endpoint := range map[string]Endpoint{
+		"no key":           {},
+		"two sources":      {KeyPath: "github_key", KeyEnv: "FLUXRECV_TEST_KEY"},
+		"missing file":     {KeyPath: "no_such_key"},
+		"unset variable":   {KeyEnv: "FLUXRECV_NO_SUCH_VARIABLE"},
+		"bad encoding":     {KeyPath: "gcr_key", KeyEncoding: "base64"},
+		"unknown encoding": {KeyPath: "github_key", KeyEncoding: "rot13"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadKey("test/fixtures", endpoint)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDerivedKeys(t *testing.T) {
+	os.Setenv("FLUXRECV_TEST_MASTER_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\n")
+	defer os.Unsetenv("FLUXRECV_TEST_MASTER_KEY")
+
+	master, err := loadMasterKey("test/fixtures", MasterKey{Env: "FLUXRECV_TEST_MASTER_KEY", Encoding: "hex"})
+	assert.NoError(t, err)
+	assert.Len(t, master, 32)
+
+	_, err = loadMasterKey("test/fixtures", MasterKey{Path: "github_key", Encoding: "hex"})
+	assert.Error(t, err, "too short")
+
+	app := Endpoint{Name: "app", Source: GitHub}
+	key, err := endpointKey("test/fixtures", app, master)
+	assert.NoError(t, err)
+	assert.Len(t, key, 2*derivedKeyLength)
+	assert.Equal(t, key, deriveKey(master, "app"))
+	assert.NotEqual(t, key, deriveKey(master, "other-app"))
+
+	// an endpoint's own key takes precedence
+	own, err := endpointKey("test/fixtures", Endpoint{Name: "app", KeyPath: "github_key"}, master)
+	assert.NoError(t, err)
+	assert.Equal(t, loadFixture(t, "github_key"), own)
+
+	_, err = endpointKey("test/fixtures", Endpoint{Source: GitHub}, master)
+	assert.Error(t, err, "no name")
+
+	digest, _, err := HandlerFromEndpoint("test/fixtures", Downstream{}, app, WithMasterKey(master))
+	assert.NoError(t, err)
+	assert.Equal(t, endpointDigest(key, app), digest)
+
+	var out bytes.Buffer
+	config := Config{
+		MasterKey: &MasterKey{Env: "FLUXRECV_TEST_MASTER_KEY", Encoding: "hex"},
+		Endpoints: []Endpoint{app, {Source: GitLab, KeyPath: "github_key"}},
+	}
+	assert.NoError(t, deriveKeys(&out, "test/fixtures", config, "https://hooks.example.com/"))
+	assert.Contains(t, out.String(), "https://hooks.example.com/hook/"+digest+"  "+string(key))
+	assert.Contains(t, out.String(), "(test/fixtures/github_key)")
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"github.com/fluxcd/flux/pkg/image"
+)
+
+// Flux v2 has no API to notify; instead, a change is passed on by
+// annotating the GitRepository or ImageRepository objects it concerns,
+// which prompts the controllers to reconcile them. A downstream with
+// `type: kubernetes` does that, through the Kubernetes API (by default,
+// that of the cluster flux-recv is running in, using its service
+// account).
+
+func init() {
+	Notifiers[downstreamKubernetes] = func(baseDir string, d Downstream) (Notifier, error) {
+		return d.kubeNotifier(baseDir)
+	}
+}
+
+const (
+	requestedAtAnnotation = "reconcile.fluxcd.io/requestedAt"
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	inClusterAPIHost  = "kubernetes.default.svc"
+)
+
+// kubeKind identifies a kind of object, by where it is in the API.
+type kubeKind struct {
+	group    string
+	version  string
+	resource string
+}
+
+// These are at the versions served by recent releases of Flux v2;
+// others can be given in the config (see withAPIVersion).
+var (
+	gitRepositoryKind   = kubeKind{"source.toolkit.fluxcd.io", "v1", "gitrepositories"}
+	imageRepositoryKind = kubeKind{"image.toolkit.fluxcd.io", "v1beta2", "imagerepositories"}
+)
+
+// withAPIVersion returns the kind at the API version given, which is
+// either a version (e.g., v1beta2), or a group and version (e.g.,
+// source.toolkit.fluxcd.io/v1beta2) as in a manifest. If it's empty,
+// the kind is returned as it is.
+func (k kubeKind) withAPIVersion(apiVersion string) (kubeKind, error) {
+	if apiVersion == "" {
+		return k, nil
+	}
+	version := apiVersion
+	if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+		if apiVersion[:i] != k.group {
+			return k, fmt.Errorf("apiVersion %q for %s is not in the API group %s", apiVersion, k.resource, k.group)
+		}
+		version = apiVersion[i+1:]
+	}
+	if version == "" || strings.ContainsAny(version, "/?#") {
+		return k, fmt.Errorf("invalid apiVersion %q for %s", apiVersion, k.resource)
+	}
+	k.version = version
+	return k, nil
+}
+
+// kubeKinds returns the kinds of object to annotate, at the API
+// versions given for the downstream, if any.
+func (d Downstream) kubeKinds() (git, img kubeKind, err error) {
+	if git, err = gitRepositoryKind.withAPIVersion(d.APIVersions.GitRepository); err != nil {
+		return
+	}
+	img, err = imageRepositoryKind.withAPIVersion(d.APIVersions.ImageRepository)
+	return
+}
+
+// kubeObject has the parts of GitRepository and ImageRepository
+// objects needed to match them against changes.
+type kubeObject struct {
+	Metadata struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		// GitRepository
+		URL string `json:"url,omitempty"`
+		Ref *struct {
+			Branch string `json:"branch,omitempty"`
+		} `json:"ref,omitempty"`
+		// ImageRepository
+		Image string `json:"image,omitempty"`
+	} `json:"spec"`
+}
+
+// kubeClient is the little of the Kubernetes API that's needed; it's
+// an interface so it can be faked in tests.
+type kubeClient interface {
+	// list returns the objects of the kind given, in the namespace
+	// given, or in all namespaces if that's empty
+	list(ctx context.Context, kind kubeKind, namespace string) ([]kubeObject, error)
+	// annotate sets an annotation on the object given
+	annotate(ctx context.Context, kind kubeKind, namespace, name, key, value string) error
+	// ping checks that the API can be reached, and serves the kind
+	// given
+	ping(ctx context.Context, kind kubeKind) error
+}
+
+type kubeNotifier struct {
+	client kubeClient
+	// namespaces in which to look for objects; all, if empty
+	namespaces []string
+	// the kinds of object to annotate, at the API versions to use
+	gitRepository   kubeKind
+	imageRepository kubeKind
+}
+
+func (n kubeNotifier) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	var kind kubeKind
+	var match func(kubeObject) bool
+	switch src := change.Source.(type) {
+	case fluxapi_v9.GitUpdate:
+		kind, match = n.gitRepository, func(obj kubeObject) bool {
+			return matchGitRepository(obj, src)
+		}
+	case fluxapi_v9.ImageUpdate:
+		kind, match = n.imageRepository, func(obj kubeObject) bool {
+			return matchImageRepository(obj, src)
+		}
+	default:
+		return fmt.Errorf("unsupported change kind %q", change.Kind)
+	}
+
+	namespaces := n.namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	requestedAt := time.Now().Format(time.RFC3339Nano)
+	var matched int
+	for _, ns := range namespaces {
+		objs, err := n.client.list(ctx, kind, ns)
+		if err != nil {
+			return fmt.Errorf("cannot list %s: %w", kind.resource, err)
+		}
+		for _, obj := range objs {
+			if !match(obj) {
+				continue
+			}
+			matched++
+			if err := n.client.annotate(ctx, kind, obj.Metadata.Namespace, obj.Metadata.Name, requestedAtAnnotation, requestedAt); err != nil {
+				return fmt.Errorf("cannot annotate %s %s/%s: %w", kind.resource, obj.Metadata.Namespace, obj.Metadata.Name, err)
+			}
+		}
+	}
+	if matched == 0 {
+		log("no", kind.resource, "match change", change.Source)
+	}
+	return nil
+}
+
+// Ping checks that GitRepository objects can be got at.
+func (n kubeNotifier) Ping(ctx context.Context) error {
+	return n.client.ping(ctx, n.gitRepository)
+}
+
+// matchGitRepository says whether a push to the repo and branch given
+// concerns the GitRepository. A GitRepository following a tag or
+// commit, or the default branch, is assumed to be concerned, since
+// that can't be told from the change.
+func matchGitRepository(obj kubeObject, src fluxapi_v9.GitUpdate) bool {
+	if normalGitURL(obj.Spec.URL) != normalGitURL(src.URL) {
+		return false
+	}
+	if src.Branch == "" || obj.Spec.Ref == nil || obj.Spec.Ref.Branch == "" {
+		return true
+	}
+	return obj.Spec.Ref.Branch == src.Branch
+}
+
+// normalGitURL reduces the various ways of writing a git repo URL to
+// host and path, so that, e.g., `git@github.com:org/repo.git` and
+// `https://github.com/org/repo` are the same.
+func normalGitURL(s string) string {
+	s = strings.TrimSpace(s)
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		s = u.Hostname() + u.Path
+	} else if i := strings.Index(s, ":"); i > 0 {
+		// scp-like, user@host:path
+		host := s[:i]
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+		s = host + "/" + strings.TrimPrefix(s[i+1:], "/")
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/"), ".git")
+	return strings.ToLower(s)
+}
+
+func matchImageRepository(obj kubeObject, src fluxapi_v9.ImageUpdate) bool {
+	ref, err := image.ParseRef(obj.Spec.Image)
+	if err != nil {
+		return false
+	}
+	return ref.Name.CanonicalName().String() == src.Name.CanonicalName().String()
+}
+
+// restKubeClient is a kubeClient that uses the Kubernetes REST API.
+type restKubeClient struct {
+	baseURL   string
+	client    *http.Client
+	tokenPath string
+}
+
+// kubeNotifier constructs a notifier for a downstream of type
+// kubernetes. If no URL is given, the API of the cluster flux-recv is
+// running in is used, with the service account's credentials (unless
+// others are given).
+func (d Downstream) kubeNotifier(baseDir string) (kubeNotifier, error) {
+	gitKind, imageKind, err := d.kubeKinds()
+	if err != nil {
+		return kubeNotifier{}, err
+	}
+	if d.URL == "" {
+		if d.CAPath == "" {
+			d.CAPath = serviceAccountDir + "/ca.crt"
+		}
+		if d.TokenPath == "" && d.CertPath == "" {
+			d.TokenPath = serviceAccountDir + "/token"
+		}
+	}
+	client, err := d.httpClient(baseDir)
+	if err != nil {
+		return kubeNotifier{}, err
+	}
+	rest := &restKubeClient{
+		baseURL: strings.TrimSuffix(d.apiURL(), "/"),
+		client:  client,
+	}
+	if d.TokenPath != "" {
+		rest.tokenPath = configPath(baseDir, d.TokenPath)
+	}
+	return kubeNotifier{
+		client:          rest,
+		namespaces:      d.Namespaces,
+		gitRepository:   gitKind,
+		imageRepository: imageKind,
+	}, nil
+}
+
+// inClusterAPIURL is the URL of the Kubernetes API, as seen from a pod.
+func inClusterAPIURL() string {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "https://" + inClusterAPIHost
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + ":" + port
+}
+
+func (c *restKubeClient) path(kind kubeKind, namespace string) string {
+	p := "/apis/" + kind.group + "/" + kind.version
+	if namespace != "" {
+		p += "/namespaces/" + url.PathEscape(namespace)
+	}
+	return p + "/" + kind.resource
+}
+
+func (c *restKubeClient) do(ctx context.Context, method, path, contentType string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.tokenPath != "" {
+		// read each time, since service account tokens are rotated
+		token, err := readSecretFile(c.tokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load API token: %s", err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(respBody, &status) == nil && status.Message != "" {
+			return nil, &responseError{status: resp.StatusCode, err: fmt.Errorf("%s: %s", resp.Status, status.Message)}
+		}
+		return nil, &responseError{status: resp.StatusCode, err: fmt.Errorf("%s", resp.Status)}
+	}
+	return respBody, nil
+}
+
+func (c *restKubeClient) list(ctx context.Context, kind kubeKind, namespace string) ([]kubeObject, error) {
+	body, err := c.do(ctx, "GET", c.path(kind, namespace), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []kubeObject `json:"items"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *restKubeClient) annotate(ctx context.Context, kind kubeKind, namespace, name, key, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "PATCH", c.path(kind, namespace)+"/"+url.PathEscape(name), "application/merge-patch+json", patch)
+	return err
+}
+
+func (c *restKubeClient) ping(ctx context.Context, kind kubeKind) error {
+	_, err := c.do(ctx, "GET", "/apis/"+kind.group+"/"+kind.version, "", nil)
+	return err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"github.com/fluxcd/flux/pkg/image"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeKubeClient struct {
+	objects   map[kubeKind][]kubeObject
+	annotated []string
+}
+
+func (c *fakeKubeClient) list(_ context.Context, kind kubeKind, namespace string) ([]kubeObject, error) {
+	var objs []kubeObject
+	for _, obj := range c.objects[kind] {
+		if namespace == "" || obj.Metadata.Namespace == namespace {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+func (c *fakeKubeClient) annotate(_ context.Context, kind kubeKind, namespace, name, key, value string) error {
+	c.annotated = append(c.annotated, kind.resource+" "+namespace+"/"+name)
+	return nil
+}
+
+func (c *fakeKubeClient) ping(context.Context, kubeKind) error {
+	return nil
+}
+
+func gitRepository(namespace, name, url, branch string) kubeObject {
+	var obj kubeObject
+	obj.Metadata.Namespace, obj.Metadata.Name = namespace, name
+	obj.Spec.URL = url
+	if branch != "" {
+		obj.Spec.Ref = &struct {
+			Branch string `json:"branch,omitempty"`
+		}{branch}
+	}
+	return obj
+}
+
+func imageRepository(namespace, name, img string) kubeObject {
+	var obj kubeObject
+	obj.Metadata.Namespace, obj.Metadata.Name = namespace, name
+	obj.Spec.Image = img
+	return obj
+}
+
+func TestKubeNotifier(t *testing.T) {
+	newClient := func() *fakeKubeClient {
+		return &fakeKubeClient{objects: map[kubeKind][]kubeObject{
+			gitRepositoryKind: {
+				gitRepository("flux-system", "config", "ssh://git@github.com/example/config", "master"),
+				gitRepository("flux-system", "config-staging", "https://github.com/example/config.git", "staging"),
+				gitRepository("team-a", "config", "https://github.com/Example/config", ""),
+				gitRepository("team-a", "other", "https://github.com/example/other", "master"),
+			},
+			imageRepositoryKind: {
+				imageRepository("flux-system", "app", "ghcr.io/example/app"),
+				imageRepository("team-a", "nginx", "nginx"),
+			},
+		}}
+	}
+	name, err := image.ParseRef("docker.io/library/nginx")
+	assert.NoError(t, err)
+
+	for _, c := range []struct {
+		name       string
+		namespaces []string
+		change     fluxapi_v9.Change
+		annotated  []string
+	}{
+		{
+			name:   "git push",
+			change: testChange, // git@github.com:example/config.git, master
+			annotated: []string{
+				"gitrepositories flux-system/config",
+				"gitrepositories team-a/config",
+			},
+		},
+		{
+			name:       "git push, in namespace",
+			namespaces: []string{"team-a"},
+			change:     testChange,
+			annotated:  []string{"gitrepositories team-a/config"},
+		},
+		{
+			name: "image push",
+			change: fluxapi_v9.Change{
+				Kind:   fluxapi_v9.ImageChange,
+				Source: fluxapi_v9.ImageUpdate{Name: name.Name},
+			},
+			annotated: []string{"imagerepositories team-a/nginx"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client := newClient()
+			n := kubeNotifier{client: client, namespaces: c.namespaces, gitRepository: gitRepositoryKind, imageRepository: imageRepositoryKind}
+			assert.NoError(t, n.NotifyChange(context.Background(), c.change))
+			sort.Strings(client.annotated)
+			assert.Equal(t, c.annotated, client.annotated)
+		})
+	}
+}
+
+func TestRestKubeClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-kube")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("s3cret\n"), 0600))
+
+	var patched map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/apis/source.toolkit.fluxcd.io/v1/gitrepositories":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"items": []kubeObject{gitRepository("flux-system", "config", "https://github.com/example/config", "")},
+			})
+		case r.Method == "PATCH" && r.URL.Path == "/apis/source.toolkit.fluxcd.io/v1/namespaces/flux-system/gitrepositories/config":
+			assert.Equal(t, "application/merge-patch+json", r.Header.Get("Content-Type"))
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&patched))
+			w.Write([]byte("{}"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	n, err := Downstream{Type: downstreamKubernetes, URL: server.URL, TokenPath: "token"}.notifier(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, n.NotifyChange(context.Background(), testChange))
+
+	annotations := patched["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	assert.Contains(t, annotations, requestedAtAnnotation)
+}
+
+func TestKubeAPIVersions(t *testing.T) {
+	for apiVersion, expected := range map[string]string{
+		"":                                 "v1",
+		"v1beta2":                          "v1beta2",
+		"source.toolkit.fluxcd.io/v1beta2": "v1beta2",
+	} {
+		kind, err := gitRepositoryKind.withAPIVersion(apiVersion)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, kind.version, apiVersion)
+	}
+	for _, apiVersion := range []string{"image.toolkit.fluxcd.io/v1beta2", "source.toolkit.fluxcd.io/", "v1/../v2"} {
+		_, err := gitRepositoryKind.withAPIVersion(apiVersion)
+		assert.Error(t, err, apiVersion)
+	}
+
+	d := Downstream{
+		Type:        downstreamKubernetes,
+		URL:         "https://kubernetes.example.com",
+		APIVersions: KubeAPIVersions{GitRepository: "v1beta2", ImageRepository: "image.toolkit.fluxcd.io/v1beta1"},
+	}
+	n, err := d.kubeNotifier("")
+	assert.NoError(t, err)
+	assert.Equal(t, "/apis/source.toolkit.fluxcd.io/v1beta2/gitrepositories", n.client.(*restKubeClient).path(n.gitRepository, ""))
+	assert.Equal(t, "v1beta1", n.imageRepository.version)
+
+	d.APIVersions.GitRepository = "image.toolkit.fluxcd.io/v1"
+	_, err = d.kubeNotifier("")
+	assert.Error(t, err)
+	assert.Error(t, d.check())
+}
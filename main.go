@@ -5,13 +5,23 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	flag "github.com/spf13/pflag"
 )
 
 const defaultApiBase = "http://localhost:3030/api/flux"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "derive-keys" {
+		deriveKeysMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay-dead-letters" {
+		replayDeadLettersMain(os.Args[2:])
+		return
+	}
 	mainArgs(os.Args[1:])
 }
 
@@ -19,12 +29,34 @@ func mainArgs(args []string) {
 	var (
 		configFile string
 		listen     string
+
+		readHeaderTimeout time.Duration
+		readTimeout       time.Duration
+		writeTimeout      time.Duration
+		idleTimeout       time.Duration
+		maxHeaderBytes    int
+
+		tlsCert string
+		tlsKey  string
+
+		ageIdentityFiles []string
+
+		dryRun bool
 	)
 
 	flags := flag.NewFlagSet("flux-recv", flag.ExitOnError)
 
 	flags.StringVar(&configFile, "config", "fluxrecv.yaml", "path to config file for flux-recv") // TODO(michael): `flux-recv help config`
 	flags.StringVar(&listen, "listen", ":8080", "address to listen on")
+	flags.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "maximum time to read request headers")
+	flags.DurationVar(&readTimeout, "read-timeout", 30*time.Second, "maximum time to read a whole request, including the body")
+	flags.DurationVar(&writeTimeout, "write-timeout", 30*time.Second, "maximum time from the end of reading request headers to the end of writing the response")
+	flags.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "maximum time to keep an idle connection open")
+	flags.IntVar(&maxHeaderBytes, "max-header-bytes", 1<<16, "maximum size of request headers")
+	flags.StringVar(&tlsCert, "tls-cert", "", "path to a TLS certificate to serve with; overrides the config file, and is reloaded if it changes")
+	flags.StringVar(&tlsKey, "tls-key", "", "path to the key for the TLS certificate")
+	flags.StringSliceVar(&ageIdentityFiles, "age-identity", nil, "path to a file of age identities with which to decrypt the config and key files, if they are encrypted; can be given more than once")
+	flags.BoolVar(&dryRun, "dry-run", false, "verify and parse requests to all endpoints, and log and respond with the changes they would pass on, without passing them on")
 
 	bail := func(msg string) {
 		fmt.Fprintln(os.Stderr, msg)
@@ -33,6 +65,10 @@ func mainArgs(args []string) {
 
 	flags.Parse(args)
 
+	if err := loadAgeIdentities(ageIdentityFiles); err != nil {
+		bail(err.Error())
+	}
+
 	config, err := ConfigFromFile(configFile)
 	if err != nil {
 		bail(err.Error())
@@ -40,27 +76,131 @@ func mainArgs(args []string) {
 
 	configDir := filepath.Dir(configFile)
 
-	apiBase := config.API
-	if apiBase == "" {
-		apiBase = defaultApiBase
+	if tlsCert == "" && tlsKey == "" && config.TLS != nil {
+		tlsCert = filepath.Join(configDir, config.TLS.CertPath)
+		tlsKey = filepath.Join(configDir, config.TLS.KeyPath)
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		bail("both a TLS certificate and key are needed to serve TLS")
 	}
+	serveTLS := tlsCert != ""
 
+	var clientCerts bool
 	for _, ep := range config.Endpoints {
-		digest, handler, err := HandlerFromEndpoint(configDir, apiBase, ep)
+		if ep.ClientCAPath != "" {
+			clientCerts = true
+		}
+	}
+	if clientCerts && !serveTLS {
+		bail("endpoints with a clientCAPath need flux-recv to serve TLS")
+	}
+
+	proxies, err := parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		bail("trustedProxies: " + err.Error())
+	}
+
+	var failureConf SignatureFailures
+	if config.SignatureFailures != nil {
+		failureConf = *config.SignatureFailures
+	}
+	failures, err := newFailureTracker(failureConf, proxies)
+	if err != nil {
+		bail(err.Error())
+	}
+	ready := newReadiness()
+	opts := []HandlerOption{WithFailureTracker(failures), WithReadiness(ready)}
+	if dryRun {
+		opts = append(opts, WithDryRun())
+	}
+
+	if config.RateLimit != nil {
+		globalLimiter, err := newRateLimiter("all endpoints", *config.RateLimit)
+		if err != nil {
+			bail(err.Error())
+		}
+		opts = append(opts, WithRateLimit(globalLimiter))
+	}
+
+	var audit *auditLog
+	if config.AuditLog != nil {
+		if audit, err = openAuditLog(configDir, *config.AuditLog); err != nil {
+			bail(err.Error())
+		}
+		opts = append(opts, WithAuditLog(audit))
+	}
+	if config.MasterKey != nil {
+		masterKey, err := loadMasterKey(configDir, *config.MasterKey)
+		if err != nil {
+			bail(err.Error())
+		}
+		opts = append(opts, WithMasterKey(masterKey))
+	}
+
+	var q *queue
+	for _, ep := range config.Endpoints {
+		// in a dry run, nothing goes through the queue, and nothing
+		// already in it should be sent
+		if dryRun {
+			break
+		}
+		if ep.Async || config.Queue != nil {
+			var queueConf Queue
+			if config.Queue != nil {
+				queueConf = *config.Queue
+			}
+			if q, err = newQueue(configDir, queueConf); err != nil {
+				bail(err.Error())
+			}
+			opts = append(opts, WithQueue(q))
+			break
+		}
+	}
+
+	for _, ep := range config.Endpoints {
+		digest, handler, err := HandlerFromEndpoint(configDir, config.API, ep, opts...)
 		if err != nil {
 			bail(err.Error())
 		}
 		route := "/hook/" + digest
 		http.Handle(route, handler)
-		println("endpoint", ep.Source, "using key", filepath.Join(configDir, ep.KeyPath), "at", route)
+		println("endpoint", ep.Source, "using key", ep.keyDescription(configDir), "at", route)
+	}
+	if q != nil {
+		q.resume()
 	}
+	// requests for hooks that don't exist are recorded too, within
+	// limits
+	http.Handle("/hook/", trackUnknownHooks(audit))
+	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
+	http.Handle("/ready", ready)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 	})
 
-	http.ListenAndServe(listen, nil)
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           withClientIP(proxies, http.DefaultServeMux),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+	if serveTLS {
+		certs, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			bail(err.Error())
+		}
+		go certs.watch(certReloadInterval)
+		server.TLSConfig = serverTLSConfig(certs, clientCerts)
+		err = server.ListenAndServeTLS("", "")
+		bail(err.Error())
+	}
+	err = server.ListenAndServe()
+	bail(err.Error())
 }
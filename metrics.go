@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are served at /metrics, in the Prometheus format.
+
+const metricsNamespace = "fluxrecv"
+
+var (
+	signatureFailuresMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "signature_failures_total",
+		Help:      "Requests that failed verification, by endpoint.",
+	}, []string{"endpoint"})
+	bannedRequestsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "banned_requests_total",
+		Help:      "Requests refused because the client is banned, by endpoint.",
+	}, []string{"endpoint"})
+	bannedClientsMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "banned_clients",
+		Help:      "Clients currently banned for failing verification.",
+	})
+	securityEventsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "security_events_total",
+		Help:      "High-severity security events raised, by event.",
+	}, []string{"event"})
+	queueDepthMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Changes queued for delivery, including those waiting to be retried.",
+	})
+	queueDroppedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_dropped_total",
+		Help:      "Changes dropped from the queue, by reason (full, expired, or unknown).",
+	}, []string{"reason"})
+	queueRetriesMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_retries_total",
+		Help:      "Attempts to deliver queued changes that failed and will be retried.",
+	})
+	forwardsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "forwards_total",
+		Help:      "Requests forwarded to other receivers, by endpoint and result (ok or error).",
+	}, []string{"endpoint", "result"})
+	deadLettersMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dead_letters_total",
+		Help:      "Messages acknowledged without being acted on, by source.",
+	}, []string{"source"})
+	coalescedChangesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "coalesced_changes_total",
+		Help:      "Changes held back because the same change was passed on within the debounce window, by endpoint.",
+	}, []string{"endpoint"})
+	unrecordedRequestsMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unrecorded_requests_total",
+		Help:      "Requests to /hook/ paths that aren't endpoints, not recorded in the audit log because there were too many.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		signatureFailuresMetric,
+		bannedRequestsMetric,
+		bannedClientsMetric,
+		securityEventsMetric,
+		queueDepthMetric,
+		queueDroppedMetric,
+		queueRetriesMetric,
+		coalescedChangesMetric,
+		forwardsMetric,
+		deadLettersMetric,
+		unrecordedRequestsMetric,
+	)
+}
@@ -9,17 +9,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
-
-	fluxapi "github.com/fluxcd/flux/pkg/api"
 )
 
 const Nexus = "Nexus"
 
 func init() {
 	Sources[Nexus] = handleNexus
+	deliveryIDHeaders[Nexus] = "X-Nexus-Webhook-Delivery"
 }
 
-func handleNexus(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Request, e Endpoint) {
+func handleNexus(s Notifier, key []byte, w http.ResponseWriter, r *http.Request, e Endpoint) {
 	if webhookID := r.Header.Get("X-Nexus-Webhook-Id"); webhookID != "rm:repository:component" {
 		http.Error(w, "Unsupported webhook ID", http.StatusBadRequest)
 		log(Nexus, "unsupported webhook ID:", webhookID)
@@ -45,6 +44,7 @@ func handleNexus(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Re
 		log(Nexus, "invalid X-Nexus-Webhook-Signature")
 		return
 	}
+	markVerified(r)
 
 	type payload struct {
 		Action string `json:"action"`
@@ -61,8 +61,10 @@ func handleNexus(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	setEvent(r.Context(), p.Action)
 	if p.Component.Format != "docker" || p.Action != "CREATED" {
-		http.Error(w, "Ignoring component format", http.StatusBadRequest)
+		recordSkipped(r.Context(), p.Component.Name, "not a docker component being created")
+		respond(w, r, http.StatusBadRequest, "Ignoring component format\n")
 		log(Nexus, "ignoring action:", p.Action, "for asset format:", p.Component.Format)
 		return
 	}
@@ -73,7 +75,7 @@ func handleNexus(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Re
 	if e.RegistryHost != "" {
 		img = strings.TrimRight(e.RegistryHost, "/") + "/" + img
 	}
-	doImageNotify(s, w, r, img)
+	doImageNotify(s, w, r, Nexus, img)
 }
 
 func verifyHmacSignature(key []byte, signature string, payload []byte) bool {
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// A downstream with `type: file` writes each change as a line of JSON
+// (see changeEvent) to a file, or to stdout; e.g., for something else
+// to tail, or for trying out a config.
+
+func init() {
+	Notifiers[downstreamFile] = func(baseDir string, d Downstream) (Notifier, error) {
+		return d.fileNotifier(baseDir)
+	}
+}
+
+type fileNotifier struct {
+	mu  *sync.Mutex
+	out io.Writer
+}
+
+// stdoutMu is shared by all the notifiers writing to stdout, so their
+// lines don't get mixed up.
+var stdoutMu sync.Mutex
+
+func (d Downstream) fileNotifier(baseDir string) (fileNotifier, error) {
+	switch d.Path {
+	case "":
+		return fileNotifier{}, fmt.Errorf("path is required")
+	case "-":
+		return fileNotifier{mu: &stdoutMu, out: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(configPath(baseDir, d.Path), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fileNotifier{}, err
+	}
+	return fileNotifier{mu: &sync.Mutex{}, out: f}, nil
+}
+
+func (n fileNotifier) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	line, err := json.Marshal(newChangeEvent(ctx, change))
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err = n.out.Write(append(line, '\n'))
+	return err
+}
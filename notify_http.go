@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// A downstream with `type: http` POSTs each change, as a JSON event,
+// to its URL; so flux-recv can verify webhooks for things other than
+// Flux.
+
+// changeEvent is how the generic notifiers (http and file) describe a
+// change; it's flatter than the Flux API's form.
+type changeEvent struct {
+	Time       time.Time `json:"time"`
+	Endpoint   string    `json:"endpoint,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	DeliveryID string    `json:"deliveryID,omitempty"`
+	// "git" or "image"
+	Kind   string `json:"kind"`
+	URL    string `json:"url,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	Image  string `json:"image,omitempty"`
+}
+
+// newChangeEvent describes the change; if it's from a delivery in
+// hand (and not, e.g., from the queue), the event says which.
+func newChangeEvent(ctx context.Context, change fluxapi_v9.Change) changeEvent {
+	ev := changeEvent{Time: time.Now().UTC(), Kind: string(change.Kind)}
+	switch src := change.Source.(type) {
+	case fluxapi_v9.GitUpdate:
+		ev.URL, ev.Branch = src.URL, src.Branch
+	case fluxapi_v9.ImageUpdate:
+		ev.Image = src.Name.String()
+	}
+	if d := deliveryFrom(ctx); d != nil {
+		d.mu.Lock()
+		ev.Endpoint, ev.Source, ev.DeliveryID = d.Endpoint, d.Source, d.DeliveryID
+		d.mu.Unlock()
+	}
+	return ev
+}
+
+func init() {
+	Notifiers[downstreamHTTP] = func(baseDir string, d Downstream) (Notifier, error) {
+		return d.httpNotifier(baseDir)
+	}
+}
+
+type httpNotifier struct {
+	url    string
+	client *http.Client
+	token  string
+}
+
+func (d Downstream) httpNotifier(baseDir string) (httpNotifier, error) {
+	if d.URL == "" {
+		return httpNotifier{}, fmt.Errorf("url is required")
+	}
+	client, err := d.httpClient(baseDir)
+	if err != nil {
+		return httpNotifier{}, err
+	}
+	n := httpNotifier{url: d.URL, client: client}
+	if d.TokenPath != "" {
+		bytes, err := readSecretFile(configPath(baseDir, d.TokenPath))
+		if err != nil {
+			return httpNotifier{}, fmt.Errorf("cannot load token: %s", err.Error())
+		}
+		n.token = strings.TrimSpace(string(bytes))
+	}
+	return n, nil
+}
+
+func (n httpNotifier) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	body, err := json.Marshal(newChangeEvent(ctx, change))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return &responseError{status: resp.StatusCode, err: fmt.Errorf("%s responded %s", n.url, resp.Status)}
+	}
+	return nil
+}
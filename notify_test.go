@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPNotifier(t *testing.T) {
+	var got changeEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer server.Close()
+
+	n, err := Downstream{Type: downstreamHTTP, URL: server.URL}.notifier("")
+	assert.NoError(t, err)
+	ctx := context.WithValue(context.Background(), deliveryKey{}, &delivery{Endpoint: "app", Source: GitHub, DeliveryID: "abc"})
+	assert.NoError(t, n.NotifyChange(ctx, testChange))
+	assert.Equal(t, "app", got.Endpoint)
+	assert.Equal(t, "abc", got.DeliveryID)
+	assert.Equal(t, "git", got.Kind)
+	assert.Equal(t, "git@github.com:example/config.git", got.URL)
+	assert.Equal(t, "master", got.Branch)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	n, err = Downstream{Type: downstreamHTTP, URL: failing.URL}.notifier("")
+	assert.NoError(t, err)
+	assert.Error(t, n.NotifyChange(context.Background(), testChange))
+}
+
+func TestFileNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-notify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	n, err := Downstream{Type: downstreamFile, Path: "changes.jsonl"}.notifier(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, n.NotifyChange(context.Background(), testChange))
+	assert.NoError(t, n.NotifyChange(context.Background(), testChange))
+
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, "changes.jsonl"))
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(bytes)), "\n")
+	assert.Len(t, lines, 2)
+	var ev changeEvent
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &ev))
+	assert.Equal(t, "git@github.com:example/config.git", ev.URL)
+}
+
+func TestUnknownNotifier(t *testing.T) {
+	_, err := Downstream{Type: "carrier-pigeon"}.notifier("")
+	assert.Error(t, err)
+}
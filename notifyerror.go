@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// When changes can't be passed on, the source is told in a way that
+// gets it to retry, if it does retries: 503 Service Unavailable if the
+// downstream couldn't be reached (e.g., fluxd is restarting), 504
+// Gateway Timeout if it didn't answer in time, and 502 Bad Gateway if
+// it answered with an error; in each case with a Retry-After.
+//
+// Sources whose retries need something else can have their own
+// mapping, in downstreamStatuses.
+
+const downstreamRetryAfter = 30 * time.Second
+
+var downstreamStatuses = map[string]func(error) int{}
+
+var downstreamMessages = map[int]string{
+	http.StatusBadGateway:         "Error while calling downstream API",
+	http.StatusServiceUnavailable: "Downstream API is unavailable",
+	http.StatusGatewayTimeout:     "Timed out waiting for response from downstream API",
+}
+
+// notifyFailed answers a request for which passing on a change failed.
+func notifyFailed(w http.ResponseWriter, r *http.Request, source string, err error) {
+	status := failedStatus(source, err)
+	if status >= 500 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(downstreamRetryAfter/time.Second)))
+	}
+	msg := downstreamMessage(status)
+	if acceptsJSON(r) {
+		resp := newDeliveryResponse(r, nil)
+		resp.Error = msg
+		writeDeliveryResponse(w, status, resp)
+	} else {
+		http.Error(w, msg, status)
+	}
+	log(source, "error from downstream:", err.Error())
+}
+
+func downstreamMessage(status int) string {
+	if msg, ok := downstreamMessages[status]; ok {
+		return msg
+	}
+	return http.StatusText(status)
+}
+
+// failedStatus is the status with which to answer the source, for an
+// error from passing on a change.
+func failedStatus(source string, err error) int {
+	if override, ok := downstreamStatuses[source]; ok {
+		return override(err)
+	}
+	return downstreamStatus(err)
+}
+
+// downstreamStatus is the status for an error from passing on a
+// change. If it failed for more than one downstream, the status is for
+// the worst failure: a timeout, then being unreachable.
+func downstreamStatus(err error) int {
+	if f, ok := err.(*fanoutError); ok {
+		status := http.StatusBadGateway
+		for _, err := range f.errs {
+			if s := downstreamStatus(err); s == http.StatusGatewayTimeout || (s == http.StatusServiceUnavailable && status == http.StatusBadGateway) {
+				status = s
+			}
+		}
+		return status
+	}
+	for ; err != nil; err = unwrapError(err) {
+		if err == context.DeadlineExceeded {
+			return http.StatusGatewayTimeout
+		}
+		if err == errQueueFull || err == errOutbox {
+			return http.StatusServiceUnavailable
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return http.StatusGatewayTimeout
+		}
+		if _, ok := err.(*net.OpError); ok {
+			return http.StatusServiceUnavailable
+		}
+	}
+	return http.StatusBadGateway
+}
+
+// responseError is an error response from a downstream. It keeps the
+// status, so that it can be told whether the change is worth sending
+// again.
+type responseError struct {
+	status int
+	err    error
+}
+
+func (e *responseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *responseError) Unwrap() error {
+	return e.err
+}
+
+// refusedPermanently says whether the change was refused in a way that
+// sending it again won't fix; that is, with a 4xx other than 408
+// Request Timeout or 429 Too Many Requests. If it failed for more than
+// one downstream, it must have been refused by all of them.
+func refusedPermanently(err error) bool {
+	if f, ok := err.(*fanoutError); ok {
+		for _, err := range f.errs {
+			if !refusedPermanently(err) {
+				return false
+			}
+		}
+		return len(f.errs) > 0
+	}
+	for ; err != nil; err = unwrapError(err) {
+		if r, ok := err.(*responseError); ok {
+			return r.status/100 == 4 && r.status != http.StatusRequestTimeout && r.status != http.StatusTooManyRequests
+		}
+	}
+	return false
+}
+
+// unwrapError gets the error underneath, whether it was wrapped by
+// fmt.Errorf with %w, or by github.com/pkg/errors.
+func unwrapError(err error) error {
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	case interface{ Cause() error }:
+		return e.Cause()
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownstreamStatus(t *testing.T) {
+	refused := &fanoutError{errs: []error{errors.New("500 Internal Server Error")}}
+	for _, tt := range []struct {
+		desc   string
+		err    error
+		status int
+	}{
+		{"error response", errors.New("401 Unauthorized"), http.StatusBadGateway},
+		{"timeout", context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"wrapped timeout", pkgerrors.Wrap(context.DeadlineExceeded, "executing HTTP request"), http.StatusGatewayTimeout},
+		{"queue full", errQueueFull, http.StatusServiceUnavailable},
+		{"outbox unwritable", fmt.Errorf("%w: disk full", errOutbox), http.StatusServiceUnavailable},
+		{"one of several failed", refused, http.StatusBadGateway},
+		{"worst of several", &fanoutError{errs: []error{errQueueFull, context.DeadlineExceeded, errors.New("nope")}}, http.StatusGatewayTimeout},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.status, downstreamStatus(tt.err))
+		})
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, pubSubStatus(context.DeadlineExceeded))
+}
+
+func TestRefusedPermanently(t *testing.T) {
+	response := func(status int) error {
+		return &responseError{status: status, err: errors.New(http.StatusText(status))}
+	}
+	for _, tt := range []struct {
+		desc     string
+		err      error
+		expected bool
+	}{
+		{"bad request", response(http.StatusBadRequest), true},
+		{"wrapped", fmt.Errorf("cannot annotate: %w", response(http.StatusForbidden)), true},
+		{"request timeout", response(http.StatusRequestTimeout), false},
+		{"too many requests", response(http.StatusTooManyRequests), false},
+		{"restarting", response(http.StatusServiceUnavailable), false},
+		{"unreachable", context.DeadlineExceeded, false},
+		{"refused by all", &fanoutError{errs: []error{response(http.StatusBadRequest), response(http.StatusNotFound)}}, true},
+		{"one may recover", &fanoutError{errs: []error{response(http.StatusBadRequest), response(http.StatusBadGateway)}}, false},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.expected, refusedPermanently(tt.err))
+		})
+	}
+}
+
+// Image sources used to answer 200 OK even if the change wasn't passed
+// on; now they say the downstream is unavailable, and when to retry.
+func TestImageSourceDownstreamUnavailable(t *testing.T) {
+	endpoint := Endpoint{Source: DockerHub, KeyPath: "dockerhub_key"}
+	// nothing listens on port 1
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: "http://127.0.0.1:1"}, endpoint)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "dockerhub_payload")))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, fmt.Sprint(int(downstreamRetryAfter.Seconds())), rec.Header().Get("Retry-After"))
+}
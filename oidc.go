@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Google signs the OIDC tokens attached to Pub/Sub push requests
+// with one of the keys published here. The keys rotate every so
+// often, so they are cached and fetched again when the cache expires,
+// or when a token turns up with a key ID we haven't seen.
+const defaultGoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+const (
+	defaultJWKSTTL  = time.Hour
+	minJWKSRefetch  = time.Minute
+	tokenClockSkew  = 30 * time.Second
+	jwksHTTPTimeout = 10 * time.Second
+)
+
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// jwksClient fetches key sets. Fetches aren't tied to the request that
+// prompted them, since others may be waiting on them too; so the
+// timeout is what stops one hanging.
+var jwksClient = &http.Client{Timeout: jwksHTTPTimeout}
+
+// keySet is a cached JSON Web Key Set.
+type keySet struct {
+	url string
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	expires   time.Time
+	lastFetch time.Time
+	// closed when the fetch in progress, if any, is done; the lock
+	// isn't held during a fetch, so that requests with keys in the
+	// cache don't wait on it
+	fetching chan struct{}
+	fetchErr error
+}
+
+var keySets = struct {
+	sync.Mutex
+	m map[string]*keySet
+}{m: map[string]*keySet{}}
+
+// keySetFor returns the (shared) key set for the URL given, so that
+// endpoints using the same JWKS don't each fetch it.
+func keySetFor(url string) *keySet {
+	keySets.Lock()
+	defer keySets.Unlock()
+	ks, ok := keySets.m[url]
+	if !ok {
+		ks = &keySet{url: url}
+		keySets.m[url] = ks
+	}
+	return ks
+}
+
+func (ks *keySet) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	ks.mu.Lock()
+	now := time.Now()
+	k, ok := ks.keys[kid]
+	if ok && now.Before(ks.expires) {
+		ks.mu.Unlock()
+		return k, nil
+	}
+	// Refresh if the cache has expired, or if this is a key we don't
+	// know (it may be newly rotated in) -- but don't let a stream of
+	// bogus key IDs, or an unreachable JWKS URL, make us hammer it.
+	// If a refresh is already under way, wait for that instead.
+	var err error
+	switch {
+	case ks.fetching != nil:
+		done := ks.fetching
+		ks.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			if ok {
+				return k, nil
+			}
+			return nil, ctx.Err()
+		}
+		ks.mu.Lock()
+		err = ks.fetchErr
+	case ks.lastFetch.IsZero() || now.Sub(ks.lastFetch) >= minJWKSRefetch:
+		err = ks.refresh(now)
+	}
+	if err != nil {
+		ks.mu.Unlock()
+		if ok {
+			// better a stale key than none at all
+			log(GoogleContainerRegistry, "could not refresh signing keys, using cached key:", err.Error())
+			return k, nil
+		}
+		return nil, err
+	}
+	k, ok = ks.keys[kid]
+	ks.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("token signed with unknown key %q", kid)
+	}
+	return k, nil
+}
+
+// refresh fetches the key set, and replaces the cached keys with it.
+// It's called with ks.mu held, and releases it during the fetch.
+func (ks *keySet) refresh(now time.Time) error {
+	ks.lastFetch = now
+	done := make(chan struct{})
+	ks.fetching = done
+	ks.mu.Unlock()
+
+	keys, ttl, err := fetchJWKS(ks.url)
+
+	ks.mu.Lock()
+	if err == nil {
+		ks.keys = keys
+		ks.expires = now.Add(ttl)
+	}
+	ks.fetchErr = err
+	ks.fetching = nil
+	close(done)
+	return err
+}
+
+// fetchJWKS fetches the RSA keys in the key set at the URL given, and
+// how long they can be cached.
+func fetchJWKS(url string) (map[string]*rsa.PublicKey, time.Duration, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot fetch signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("cannot fetch signing keys: %s", resp.Status)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, 0, fmt.Errorf("cannot decode signing keys: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot decode modulus of key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot decode exponent of key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, maxAge(resp.Header.Get("Cache-Control"), defaultJWKSTTL), nil
+}
+
+// maxAge extracts the max-age directive from a Cache-Control header
+// value, if there is one.
+func maxAge(cacheControl string, otherwise time.Duration) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, "max-age=") {
+			if secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && secs > 0 {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return otherwise
+}
+
+type idTokenClaims struct {
+	Iss           string   `json:"iss"`
+	Aud           audience `json:"aud"`
+	Exp           int64    `json:"exp"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+}
+
+// audience may be given as a single string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyIDToken checks the signature and claims of an OIDC ID token
+// (a JWT) against the key set and the expectations given.
+func verifyIDToken(ctx context.Context, ks *keySet, token string, expect GCRAuth, now time.Time) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("cannot decode token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unexpected token signing algorithm %q", header.Alg)
+	}
+
+	key, err := ks.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode token signature: %w", err)
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, fmt.Errorf("token signature is invalid")
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("cannot decode token claims: %w", err)
+	}
+	if !validIssuer(claims.Iss) {
+		return nil, fmt.Errorf("token issued by unexpected issuer %q", claims.Iss)
+	}
+	if now.After(time.Unix(claims.Exp, 0).Add(tokenClockSkew)) {
+		return nil, fmt.Errorf("token expired at %s", time.Unix(claims.Exp, 0).UTC().Format(time.RFC3339))
+	}
+	if !claims.Aud.contains(expect.Audience) {
+		return nil, fmt.Errorf("token intended for a different audience: %v", []string(claims.Aud))
+	}
+	if expect.Email != "" && (claims.Email != expect.Email || !claims.EmailVerified) {
+		return nil, fmt.Errorf("token issued to unexpected service account %q", claims.Email)
+	}
+	return &claims, nil
+}
+
+func validIssuer(iss string) bool {
+	for _, i := range googleIssuers {
+		if iss == i {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, v)
+}
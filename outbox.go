@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// The queue can be backed by an outbox file, so that changes still in
+// the queue survive flux-recv being restarted. The file is a
+// write-ahead log, with a line of JSON for each change added to the
+// queue, and for each change that's done with (delivered or dropped).
+// When flux-recv starts, it reads the file to find the changes that
+// weren't done with, and rewrites the file with only those.
+//
+// Changes are written to the file before the request is answered,
+// but marking them done isn't synced; so, after a crash, a change may
+// be delivered twice, but shouldn't be lost.
+
+const (
+	outboxAdd  = "add"
+	outboxDone = "done"
+
+	// rewrite the file once it has this many records of changes done
+	// with, and more of those than of changes pending
+	outboxCompactThreshold = 1000
+)
+
+type outboxRecord struct {
+	Op       string             `json:"op"`
+	ID       uint64             `json:"id"`
+	Target   string             `json:"target,omitempty"`
+	Change   *fluxapi_v9.Change `json:"change,omitempty"`
+	Enqueued *time.Time         `json:"enqueued,omitempty"`
+}
+
+type outbox struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	nextID  uint64
+	pending map[uint64]*queueItem
+	done    int
+}
+
+// openOutbox reads the outbox file, if there is one, and returns the
+// changes in it that weren't done with, oldest first. The file is
+// rewritten with only those changes.
+func openOutbox(path string) (*outbox, []*queueItem, error) {
+	o := &outbox{path: path, nextID: 1, pending: map[uint64]*queueItem{}}
+	if err := o.load(); err != nil {
+		return nil, nil, fmt.Errorf("cannot load outbox %s: %s", path, err.Error())
+	}
+	if err := o.compact(); err != nil {
+		return nil, nil, fmt.Errorf("cannot rewrite outbox %s: %s", path, err.Error())
+	}
+	var items []*queueItem
+	for _, item := range o.pending {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].id < items[j].id })
+	return o, items, nil
+}
+
+func (o *outbox) load() error {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// a record that didn't get written completely, e.g.,
+				// because of a crash; the change it was for can't have
+				// been acknowledged
+				log("ignoring incomplete record at end of outbox", o.path)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec outboxRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("line %d: %s", n, err.Error())
+		}
+		switch rec.Op {
+		case outboxAdd:
+			if rec.Change == nil || rec.Enqueued == nil {
+				return fmt.Errorf("line %d: incomplete record", n)
+			}
+			o.pending[rec.ID] = &queueItem{
+				id:       rec.ID,
+				target:   rec.Target,
+				change:   *rec.Change,
+				enqueued: *rec.Enqueued,
+			}
+		case outboxDone:
+			delete(o.pending, rec.ID)
+		default:
+			return fmt.Errorf("line %d: unknown op %q", n, rec.Op)
+		}
+		if rec.ID >= o.nextID {
+			o.nextID = rec.ID + 1
+		}
+	}
+}
+
+// compact rewrites the file with only the changes still pending, and
+// opens it for appending. Call with the lock held (or before the
+// outbox is in use).
+func (o *outbox) compact() error {
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, item := range o.pending {
+		if err := writeRecord(w, addRecord(item)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+
+	if o.file != nil {
+		o.file.Close()
+	}
+	if o.file, err = os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	o.done = 0
+	return nil
+}
+
+func addRecord(item *queueItem) outboxRecord {
+	change, enqueued := item.change, item.enqueued
+	return outboxRecord{
+		Op:       outboxAdd,
+		ID:       item.id,
+		Target:   item.target,
+		Change:   &change,
+		Enqueued: &enqueued,
+	}
+}
+
+func writeRecord(w io.Writer, rec outboxRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// add gives the item an ID, and writes it to the file.
+func (o *outbox) add(item *queueItem) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	item.id = o.nextID
+	o.nextID++
+	if err := writeRecord(o.file, addRecord(item)); err != nil {
+		return err
+	}
+	o.pending[item.id] = item
+	return o.file.Sync()
+}
+
+// markDone records that the item is done with, and rewrites the file
+// if it's got big enough.
+func (o *outbox) markDone(item *queueItem) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.pending[item.id]; !ok {
+		return nil
+	}
+	delete(o.pending, item.id)
+	if err := writeRecord(o.file, outboxRecord{Op: outboxDone, ID: item.id}); err != nil {
+		return err
+	}
+	o.done++
+	if o.done >= outboxCompactThreshold && o.done > len(o.pending) {
+		return o.compact()
+	}
+	return nil
+}
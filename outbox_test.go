@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+type notifierFunc func(context.Context, fluxapi_v9.Change) error
+
+func (f notifierFunc) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	return f(ctx, change)
+}
+
+var testChange = fluxapi_v9.Change{
+	Kind:   fluxapi_v9.GitChange,
+	Source: fluxapi_v9.GitUpdate{URL: "git@github.com:example/config.git", Branch: "master"},
+}
+
+// Changes that were queued but not delivered before a "restart" should
+// be delivered after it.
+func TestOutboxResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// fluxd is down, so nothing gets delivered
+	down := notifierFunc(func(context.Context, fluxapi_v9.Change) error {
+		return context.DeadlineExceeded
+	})
+	before, err := newQueue(dir, Queue{Path: "outbox", MinBackoff: Duration(time.Hour)})
+	assert.NoError(t, err)
+	before.resume()
+	assert.NoError(t, before.notifier("app -> fluxd", down).NotifyChange(context.Background(), testChange))
+	assert.NoError(t, before.notifier("gone -> fluxd", down).NotifyChange(context.Background(), testChange))
+
+	var mu sync.Mutex
+	var delivered []fluxapi_v9.Change
+	up := notifierFunc(func(_ context.Context, change fluxapi_v9.Change) error {
+		mu.Lock()
+		delivered = append(delivered, change)
+		mu.Unlock()
+		return nil
+	})
+	after, err := newQueue(dir, Queue{Path: "outbox"})
+	assert.NoError(t, err)
+	after.notifier("app -> fluxd", up)
+	after.resume()
+
+	eventually(t, func() bool { return after.depth() == 0 })
+	mu.Lock()
+	assert.Equal(t, []fluxapi_v9.Change{testChange}, delivered)
+	mu.Unlock()
+
+	// everything is done with, so there's nothing left after
+	// rewriting
+	_, items, err := openOutbox(filepath.Join(dir, "outbox"))
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+}
+
+// A change that can't be written to the outbox isn't queued, since it
+// wouldn't survive a restart; the request is refused instead.
+func TestOutboxWriteFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := newQueue(dir, Queue{Path: "outbox"})
+	assert.NoError(t, err)
+	q.resume()
+	q.outbox.file.Close()
+
+	err = q.notifier("app -> fluxd", notifierFunc(func(context.Context, fluxapi_v9.Change) error {
+		return nil
+	})).NotifyChange(context.Background(), testChange)
+	assert.True(t, errors.Is(err, errOutbox))
+	assert.Equal(t, http.StatusServiceUnavailable, downstreamStatus(err))
+	assert.Equal(t, 0, q.depth())
+}
+
+func TestOutboxExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox")
+
+	o, _, err := openOutbox(path)
+	assert.NoError(t, err)
+	assert.NoError(t, o.add(&queueItem{target: "app -> fluxd", change: testChange, enqueued: time.Now().Add(-2 * time.Hour)}))
+	assert.NoError(t, o.add(&queueItem{target: "app -> fluxd", change: testChange, enqueued: time.Now()}))
+
+	var mu sync.Mutex
+	var calls int
+	q, err := newQueue(dir, Queue{Path: "outbox", MaxAge: Duration(time.Hour)})
+	assert.NoError(t, err)
+	q.notifier("app -> fluxd", notifierFunc(func(context.Context, fluxapi_v9.Change) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return nil
+	}))
+	q.resume()
+	eventually(t, func() bool { return q.depth() == 0 })
+	mu.Lock()
+	assert.Equal(t, 1, calls)
+	mu.Unlock()
+}
+
+func TestOutboxIncompleteRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox")
+
+	o, _, err := openOutbox(path)
+	assert.NoError(t, err)
+	assert.NoError(t, o.add(&queueItem{target: "app -> fluxd", change: testChange, enqueued: time.Now()}))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	f.WriteString(`{"op":"add","id":2,"target":"app -> fl`)
+	f.Close()
+
+	_, items, err := openOutbox(path)
+	assert.NoError(t, err)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, uint64(1), items[0].id)
+		assert.Equal(t, testChange, items[0].change)
+	}
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(b), "\n"))
+}
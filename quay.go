@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-
-	fluxapi "github.com/fluxcd/flux/pkg/api"
 )
 
 const Quay = "Quay"
@@ -13,7 +11,7 @@ func init() {
 	Sources[Quay] = handleQuay
 }
 
-func handleQuay(s fluxapi.Server, _ []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
+func handleQuay(s Notifier, _ []byte, w http.ResponseWriter, r *http.Request, _ Endpoint) {
 	type payload struct {
 		RepoName string `json:"docker_url"`
 	}
@@ -23,5 +21,5 @@ func handleQuay(s fluxapi.Server, _ []byte, w http.ResponseWriter, r *http.Reque
 		log(Quay, err.Error())
 		return
 	}
-	doImageNotify(s, w, r, p.RepoName)
+	doImageNotify(s, w, r, Quay, p.RepoName)
 }
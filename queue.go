@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// Endpoints marked async don't wait for changes to be passed on
+// before responding (which can take a while, and fails if fluxd is
+// restarting); instead, the changes are put in a queue, and the
+// request is answered with 202 Accepted. The queue is worked through
+// in the background, retrying with exponential backoff until each
+// change is delivered or gets too old.
+//
+// The queue is per downstream, underneath the fan-out (see
+// fanout.go), so a change that fails for one downstream is retried
+// only there.
+
+const (
+	defaultQueueSize       = 1000
+	defaultQueueWorkers    = 4
+	defaultQueueMaxAge     = time.Hour
+	defaultQueueMinBackoff = time.Second
+	defaultQueueMaxBackoff = 5 * time.Minute
+)
+
+const resultQueued = "queued"
+
+var (
+	errQueueFull = errors.New("queue is full")
+	// the change couldn't be written to the outbox, so it wouldn't
+	// survive a restart; it's refused, as when the queue is full
+	errOutbox = errors.New("cannot write change to outbox")
+)
+
+const (
+	dropFull    = "full"
+	dropExpired = "expired"
+	// the downstream is no longer in the config
+	dropUnknown = "unknown"
+)
+
+type queueItem struct {
+	// identifies the item in the outbox, if there is one
+	id       uint64
+	target   string
+	change   fluxapi_v9.Change
+	enqueued time.Time
+	attempts int
+	// whether it's been counted as pending
+	counted bool
+}
+
+type queue struct {
+	maxAge     time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	items chan *queueItem
+
+	outbox    *outbox
+	recovered []*queueItem
+
+	mu      sync.Mutex
+	targets map[string]Notifier
+	pending int
+}
+
+func newQueue(baseDir string, conf Queue) (*queue, error) {
+	if conf.Size < 0 || conf.Workers < 0 || conf.MaxAge < 0 || conf.MinBackoff < 0 || conf.MaxBackoff < 0 {
+		return nil, fmt.Errorf("queue: sizes and durations must not be negative")
+	}
+	size, workers := conf.Size, conf.Workers
+	if size == 0 {
+		size = defaultQueueSize
+	}
+	if workers == 0 {
+		workers = defaultQueueWorkers
+	}
+	q := &queue{
+		maxAge:     time.Duration(conf.MaxAge),
+		minBackoff: time.Duration(conf.MinBackoff),
+		maxBackoff: time.Duration(conf.MaxBackoff),
+		items:      make(chan *queueItem, size),
+		targets:    map[string]Notifier{},
+	}
+	if q.maxAge == 0 {
+		q.maxAge = defaultQueueMaxAge
+	}
+	if q.minBackoff == 0 {
+		q.minBackoff = defaultQueueMinBackoff
+	}
+	if q.maxBackoff == 0 {
+		q.maxBackoff = defaultQueueMaxBackoff
+	}
+	if q.maxBackoff < q.minBackoff {
+		q.maxBackoff = q.minBackoff
+	}
+	if conf.Path != "" {
+		path := conf.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		var err error
+		if q.outbox, q.recovered, err = openOutbox(path); err != nil {
+			return nil, fmt.Errorf("queue: %s", err.Error())
+		}
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q, nil
+}
+
+// notifier returns a Notifier that queues changes for delivery to the
+// target given, which is known by the name given.
+func (q *queue) notifier(name string, target Notifier) Notifier {
+	q.mu.Lock()
+	q.targets[name] = target
+	q.mu.Unlock()
+	return queuedNotifier{queue: q, target: name}
+}
+
+type queuedNotifier struct {
+	queue  *queue
+	target string
+}
+
+func (n queuedNotifier) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	item := &queueItem{target: n.target, change: change, enqueued: time.Now()}
+	if err := n.queue.add(item); err != nil {
+		return err
+	}
+	if res := targetResultFrom(ctx); res != nil {
+		res.Result = resultQueued
+	}
+	return nil
+}
+
+// resume queues the changes recovered from the outbox, except those
+// that are too old. Call it once the targets have all been given (with
+// notifier), so that changes for targets no longer in the config can
+// be dropped.
+func (q *queue) resume() {
+	items := q.recovered
+	q.recovered = nil
+	if len(items) > 0 {
+		log("resuming delivery of", len(items), "changes from outbox")
+	}
+	for _, item := range items {
+		item.counted = true
+		q.changePending(1)
+		if time.Since(item.enqueued) > q.maxAge {
+			q.drop(item, dropExpired)
+			continue
+		}
+		q.add(item)
+	}
+}
+
+// add puts an item in the queue, if there's room. New items are
+// written to the outbox first, if there is one; if that fails, the
+// item isn't queued.
+func (q *queue) add(item *queueItem) error {
+	if !item.counted && q.outbox != nil {
+		if err := q.outbox.add(item); err != nil {
+			log("could not write change for", item.target, "to outbox:", err.Error())
+			q.finish(item)
+			return fmt.Errorf("%w: %s", errOutbox, err.Error())
+		}
+	}
+	select {
+	case q.items <- item:
+		if !item.counted {
+			item.counted = true
+			q.changePending(1)
+		}
+		return nil
+	default:
+		q.drop(item, dropFull)
+		return errQueueFull
+	}
+}
+
+func (q *queue) changePending(n int) {
+	q.mu.Lock()
+	q.pending += n
+	queueDepthMetric.Set(float64(q.pending))
+	q.mu.Unlock()
+}
+
+func (q *queue) drop(item *queueItem, reason string) {
+	queueDroppedMetric.WithLabelValues(reason).Inc()
+	q.finish(item)
+	log("dropped change for", item.target, "from queue ("+reason+") after", item.attempts, "attempts")
+}
+
+// finish is for when an item has been delivered or dropped.
+func (q *queue) finish(item *queueItem) {
+	if item.counted {
+		q.changePending(-1)
+	}
+	if q.outbox != nil {
+		if err := q.outbox.markDone(item); err != nil {
+			log("could not mark change for", item.target, "done in outbox:", err.Error())
+		}
+	}
+}
+
+func (q *queue) work() {
+	for item := range q.items {
+		q.attempt(item)
+	}
+}
+
+// attempt tries to deliver the item, and if that fails, arranges for
+// it to be retried after a backoff (unless it would be too old by
+// then).
+func (q *queue) attempt(item *queueItem) {
+	q.mu.Lock()
+	target, ok := q.targets[item.target]
+	q.mu.Unlock()
+	if !ok {
+		q.drop(item, dropUnknown)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := target.NotifyChange(ctx, item.change)
+	cancel()
+	item.attempts++
+	if err == nil {
+		q.finish(item)
+		if item.attempts > 1 {
+			log("delivered change to", item.target, "after", item.attempts, "attempts")
+		}
+		return
+	}
+
+	backoff := q.backoff(item.attempts)
+	if time.Since(item.enqueued)+backoff > q.maxAge {
+		log("could not deliver change to", item.target+":", err.Error())
+		q.drop(item, dropExpired)
+		return
+	}
+	queueRetriesMetric.Inc()
+	time.AfterFunc(backoff, func() {
+		q.add(item)
+	})
+}
+
+// backoff is how long to wait before the next attempt: it doubles
+// with each attempt, up to the maximum, and is jittered so that
+// retries don't all arrive at once.
+func (q *queue) backoff(attempts int) time.Duration {
+	d := q.minBackoff
+	for i := 1; i < attempts && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.maxBackoff {
+		d = q.maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// acceptQueued changes the response from 200 OK to 202 Accepted if
+// any of the changes in the delivery were queued rather than
+// delivered.
+func acceptQueued(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&acceptedWriter{ResponseWriter: w, d: deliveryFrom(r.Context())}, r)
+	})
+}
+
+type acceptedWriter struct {
+	http.ResponseWriter
+	d           *delivery
+	wroteHeader bool
+}
+
+func (w *acceptedWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK && w.d != nil && w.d.queued() {
+		code = http.StatusAccepted
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *acceptedWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a downstream that fails the first so many times it's called
+type flakyDownstream struct {
+	mu        sync.Mutex
+	failures  int
+	calls     int
+	delivered int
+}
+
+func (f *flakyDownstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		http.Error(w, "restarting", http.StatusServiceUnavailable)
+		return
+	}
+	f.delivered++
+	fmt.Fprintln(w, `{"status": "OK"}`)
+}
+
+func (f *flakyDownstream) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls, f.delivered
+}
+
+func (q *queue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Error("condition not met in time")
+}
+
+func sendGitlabPush(t *testing.T, handler http.Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "gitlab_payload")))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gitlab-Event", "Push Hook")
+	req.Header.Set("X-Gitlab-Token", string(loadFixture(t, "dockerhub_key")))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func Test_AsyncDelivery(t *testing.T) {
+	flaky := &flakyDownstream{failures: 2}
+	downstream := httptest.NewServer(flaky)
+	defer downstream.Close()
+
+	q, err := newQueue("", Queue{MinBackoff: Duration(10 * time.Millisecond), MaxBackoff: Duration(20 * time.Millisecond)})
+	assert.NoError(t, err)
+
+	endpoint := Endpoint{Source: GitLab, KeyPath: "dockerhub_key", Async: true}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint, WithQueue(q))
+	assert.NoError(t, err)
+
+	rec := sendGitlabPush(t, handler)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	eventually(t, func() bool {
+		_, delivered := flaky.counts()
+		return delivered == 1
+	})
+	calls, _ := flaky.counts()
+	assert.Equal(t, 3, calls)
+	eventually(t, func() bool { return q.depth() == 0 })
+}
+
+func Test_AsyncDeliveryExpires(t *testing.T) {
+	flaky := &flakyDownstream{failures: 1000}
+	downstream := httptest.NewServer(flaky)
+	defer downstream.Close()
+
+	q, err := newQueue("", Queue{
+		MaxAge:     Duration(100 * time.Millisecond),
+		MinBackoff: Duration(10 * time.Millisecond),
+		MaxBackoff: Duration(20 * time.Millisecond),
+	})
+	assert.NoError(t, err)
+
+	endpoint := Endpoint{Source: GitLab, KeyPath: "dockerhub_key", Async: true}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint, WithQueue(q))
+	assert.NoError(t, err)
+
+	rec := sendGitlabPush(t, handler)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	eventually(t, func() bool { return q.depth() == 0 })
+	calls, delivered := flaky.counts()
+	assert.True(t, calls > 1)
+	assert.Zero(t, delivered)
+}
+
+func TestQueueFull(t *testing.T) {
+	// no workers, so nothing is taken off the queue
+	q := &queue{items: make(chan *queueItem, 1), targets: map[string]Notifier{}}
+	assert.NoError(t, q.add(&queueItem{target: "foo"}))
+	assert.Equal(t, errQueueFull, q.add(&queueItem{target: "foo"}))
+	assert.Equal(t, 1, q.depth())
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := &queue{minBackoff: time.Second, maxBackoff: 10 * time.Second}
+	for attempts, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+		d := q.backoff(attempts)
+		assert.True(t, d >= max/2 && d <= max, "attempts %d: %s", attempts, d)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Every request that gets past verification costs a call to the
+// downstream API, and the /hook/ paths are public; so, a misbehaving
+// provider (or someone with the URL) could make flux-recv hammer
+// fluxd. Rate limits put a bound on that.
+
+const (
+	// how often to report the number of rejected requests (at most)
+	rateLimitReportInterval = time.Minute
+	// how often to forget about clients that have gone quiet
+	rateLimitSweepInterval = time.Minute
+)
+
+type rateLimiter struct {
+	name      string
+	total     *rate.Limiter
+	perClient *Limit
+
+	mu         sync.Mutex
+	clients    map[string]*clientLimiter
+	nextSweep  time.Time
+	rejected   int
+	lastReport time.Time
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func (l Limit) validate() error {
+	if l.Rate <= 0 {
+		return fmt.Errorf("rate must be greater than zero")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	return nil
+}
+
+// burst defaults to a second's worth of requests.
+func (l Limit) burst() int {
+	if l.Burst == 0 {
+		return int(math.Ceil(l.Rate))
+	}
+	return l.Burst
+}
+
+func (l Limit) limiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(l.Rate), l.burst())
+}
+
+func newRateLimiter(name string, conf RateLimit) (*rateLimiter, error) {
+	l := &rateLimiter{
+		name:      name,
+		perClient: conf.PerClient,
+		clients:   map[string]*clientLimiter{},
+	}
+	if conf.Total != nil {
+		if err := conf.Total.validate(); err != nil {
+			return nil, fmt.Errorf("rate limit for %s: total: %s", name, err.Error())
+		}
+		l.total = conf.Total.limiter()
+	}
+	if conf.PerClient != nil {
+		if err := conf.PerClient.validate(); err != nil {
+			return nil, fmt.Errorf("rate limit for %s: perClient: %s", name, err.Error())
+		}
+	}
+	return l, nil
+}
+
+// allow takes a token from the buckets for the client given (if
+// limiting per client) and from the total. If there isn't a token
+// available, it returns how long until there will be.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var clientRes *rate.Reservation
+	if l.perClient != nil {
+		c, ok := l.clients[client]
+		if !ok {
+			c = &clientLimiter{limiter: l.perClient.limiter()}
+			l.clients[client] = c
+		}
+		c.lastSeen = now
+		clientRes = c.limiter.ReserveN(now, 1)
+		if d := clientRes.DelayFrom(now); d > 0 {
+			clientRes.CancelAt(now)
+			return l.reject(client, d, now)
+		}
+	}
+	if l.total != nil {
+		res := l.total.ReserveN(now, 1)
+		if d := res.DelayFrom(now); d > 0 {
+			res.CancelAt(now)
+			if clientRes != nil {
+				clientRes.CancelAt(now)
+			}
+			return l.reject(client, d, now)
+		}
+	}
+	l.sweep(now)
+	return true, 0
+}
+
+// reject counts a rejected request, and reports the count since last
+// time, if it's been long enough. Call with the lock held.
+func (l *rateLimiter) reject(client string, retryAfter time.Duration, now time.Time) (bool, time.Duration) {
+	l.rejected++
+	if now.Sub(l.lastReport) >= rateLimitReportInterval {
+		if l.lastReport.IsZero() {
+			log("rate limit for", l.name, "exceeded, starting with client", client)
+		} else {
+			log("rate limit for", l.name, "rejected", l.rejected, "requests since", l.lastReport.UTC().Format(time.RFC3339))
+		}
+		l.rejected = 0
+		l.lastReport = now
+	}
+	return false, retryAfter
+}
+
+// sweep forgets about clients that have been quiet for long enough
+// that their bucket would be full again anyway. Call with the lock
+// held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if l.perClient == nil || now.Before(l.nextSweep) {
+		return
+	}
+	l.nextSweep = now.Add(rateLimitSweepInterval)
+	refill := time.Duration(float64(l.perClient.burst()) / l.perClient.Rate * float64(time.Second))
+	for client, c := range l.clients {
+		if now.Sub(c.lastSeen) > refill {
+			delete(l.clients, client)
+		}
+	}
+}
+
+func (l *rateLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, retryAfter := l.allow(clientIP(r).String(), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
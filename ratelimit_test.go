@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l, err := newRateLimiter("test", RateLimit{
+		Total:     &Limit{Rate: 10, Burst: 3},
+		PerClient: &Limit{Rate: 1, Burst: 2},
+	})
+	assert.NoError(t, err)
+
+	now := time.Now()
+	ok, _ := l.allow("a", now)
+	assert.True(t, ok)
+	ok, _ = l.allow("a", now)
+	assert.True(t, ok)
+	// client a has used its burst
+	ok, retry := l.allow("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retry)
+
+	// .. but b has not; however, that's the total burst used up
+	ok, _ = l.allow("b", now)
+	assert.True(t, ok)
+	ok, retry = l.allow("b", now)
+	assert.False(t, ok)
+	assert.Equal(t, 100*time.Millisecond, retry)
+
+	// a refuses to give up, but only the refilled token counts
+	ok, _ = l.allow("a", now.Add(time.Second))
+	assert.True(t, ok)
+	ok, _ = l.allow("a", now.Add(time.Second))
+	assert.False(t, ok)
+}
+
+func TestRateLimiterResponse(t *testing.T) {
+	l, err := newRateLimiter("test", RateLimit{PerClient: &Limit{Rate: 0.1, Burst: 1}})
+	assert.NoError(t, err)
+	handler := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/hook/foo", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/hook/foo", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "10", rec.Header().Get("Retry-After"))
+}
+
+// The rate limit for all endpoints is shared by them, and requests it
+// refuses are recorded like any others.
+func TestRateLimitAllEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-ratelimit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	audit, err := openAuditLog(dir, AuditLog{Path: "audit.log"})
+	assert.NoError(t, err)
+	l, err := newRateLimiter("all endpoints", RateLimit{Total: &Limit{Rate: 0.1, Burst: 1}})
+	assert.NoError(t, err)
+
+	var handlers []http.Handler
+	for _, name := range []string{"one", "two"} {
+		endpoint := Endpoint{Name: name, Source: DockerHub, KeyPath: "dockerhub_key"}
+		_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{Type: downstreamFile, Path: os.DevNull}, endpoint, WithRateLimit(l), WithAuditLog(audit))
+		assert.NoError(t, err)
+		handlers = append(handlers, handler)
+	}
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(loadFixture(t, "dockerhub_payload")))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handlers[i].ServeHTTP(rec, req)
+		assert.Equal(t, expected, rec.Code)
+	}
+
+	records := readAuditLog(t, filepath.Join(dir, "audit.log"))
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "two", records[1].Endpoint)
+		assert.Equal(t, http.StatusTooManyRequests, records[1].Status)
+		assert.Equal(t, verificationRefused, records[1].Verification)
+	}
+}
+
+func TestBadRateLimits(t *testing.T) {
+	_, err := newRateLimiter("test", RateLimit{Total: &Limit{Rate: 0}})
+	assert.Error(t, err)
+	_, err = newRateLimiter("test", RateLimit{PerClient: &Limit{Rate: 1, Burst: -1}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// /health says only that flux-recv is running. /ready also checks
+// that the downstreams can be reached, so that, e.g., webhooks aren't
+// routed to a pod whose fluxd is still starting (where they would be
+// lost). Checking each downstream is a request, so the results are
+// kept for a little while.
+//
+// Only downstreams that can be checked without passing on a change
+// are: the Flux API (which has a ping call), and the Kubernetes API.
+
+const (
+	readyCacheFor = 10 * time.Second
+	readyTimeout  = 5 * time.Second
+)
+
+// pinger is implemented by notifiers whose downstream can be checked.
+type pinger interface {
+	Ping(context.Context) error
+}
+
+type readyResult struct {
+	Target string `json:"target"`
+	Ready  bool   `json:"ready"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readyReport struct {
+	Ready   bool          `json:"ready"`
+	Checked time.Time     `json:"checked"`
+	Targets []readyResult `json:"targets"`
+}
+
+type readiness struct {
+	cacheFor time.Duration
+
+	mu      sync.Mutex
+	targets []target
+	names   map[string]bool
+	last    *readyReport
+}
+
+func newReadiness() *readiness {
+	return &readiness{cacheFor: readyCacheFor, names: map[string]bool{}}
+}
+
+// add includes the downstream in the checks, if it can be checked
+// (and isn't already included).
+func (rd *readiness) add(t target) {
+	if _, ok := t.notifier.(pinger); !ok {
+		return
+	}
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.names[t.name] {
+		return
+	}
+	rd.names[t.name] = true
+	rd.targets = append(rd.targets, t)
+	rd.last = nil
+}
+
+// check returns the results of checking all the downstreams, either
+// from the last time, or afresh if that was too long ago.
+func (rd *readiness) check(ctx context.Context) readyReport {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.last != nil && time.Since(rd.last.Checked) < rd.cacheFor {
+		return *rd.last
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	report := readyReport{Ready: true, Targets: make([]readyResult, len(rd.targets))}
+	var wg sync.WaitGroup
+	for i := range rd.targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			t := rd.targets[i]
+			res := readyResult{Target: t.name, Ready: true}
+			if err := t.notifier.(pinger).Ping(ctx); err != nil {
+				res.Ready, res.Error = false, err.Error()
+			}
+			report.Targets[i] = res
+		}(i)
+	}
+	wg.Wait()
+	for _, res := range report.Targets {
+		if !res.Ready {
+			report.Ready = false
+		}
+	}
+	report.Checked = time.Now().UTC()
+	rd.last = &report
+	return report
+}
+
+// ServeHTTP responds 200 OK if all the downstreams are ready, and 503
+// Service Unavailable otherwise, with the details as JSON.
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := rd.check(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
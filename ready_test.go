@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a Flux API that answers pings, or doesn't
+type pingServer struct {
+	mu    sync.Mutex
+	up    bool
+	pings int
+}
+
+func (p *pingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r.URL.Path == "/v11/ping" {
+		p.pings++
+	}
+	if !p.up {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *pingServer) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pings
+}
+
+func TestReady(t *testing.T) {
+	upAPI := &pingServer{up: true}
+	up := httptest.NewServer(upAPI)
+	defer up.Close()
+	downAPI := &pingServer{}
+	down := httptest.NewServer(downAPI)
+	defer down.Close()
+
+	rd := newReadiness()
+	for _, ep := range []Endpoint{
+		{Source: GitLab, KeyPath: "dockerhub_key", Downstreams: []Downstream{{URL: up.URL}, {URL: down.URL}}},
+		// the same downstream again is checked only once
+		{Source: DockerHub, KeyPath: "dockerhub_key", Downstreams: []Downstream{{URL: up.URL}}},
+		// and those that can't be checked aren't
+		{Source: DockerHub, KeyPath: "dockerhub_key", Downstreams: []Downstream{{Type: downstreamHTTP, URL: up.URL}}},
+	} {
+		_, _, err := HandlerFromEndpoint("test/fixtures", Downstream{}, ep, WithReadiness(rd))
+		assert.NoError(t, err)
+	}
+
+	get := func() (int, readyReport) {
+		rec := httptest.NewRecorder()
+		rd.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+		var report readyReport
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		return rec.Code, report
+	}
+
+	code, report := get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, report.Ready)
+	assert.Len(t, report.Targets, 2)
+	assert.Equal(t, up.URL, report.Targets[0].Target)
+	assert.True(t, report.Targets[0].Ready)
+	assert.False(t, report.Targets[1].Ready)
+	assert.NotEmpty(t, report.Targets[1].Error)
+	assert.Equal(t, 1, upAPI.count())
+
+	// the result is kept for a while ...
+	downAPI.mu.Lock()
+	downAPI.up = true
+	downAPI.mu.Unlock()
+	code, _ = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, 1, upAPI.count())
+
+	// ... and then checked again
+	rd.mu.Lock()
+	rd.last.Checked = time.Now().Add(-readyCacheFor)
+	rd.mu.Unlock()
+	code, report = get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, report.Ready)
+	assert.Equal(t, 2, upAPI.count())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	flag "github.com/spf13/pflag"
+)
+
+// replayDeadLettersMain is the `replay-dead-letters` subcommand, which
+// tries again to pass on the changes in dead-lettered messages (e.g.,
+// once the downstream has been fixed). Messages that succeed are
+// removed from the dead-letter file; the rest are kept.
+func replayDeadLettersMain(args []string) {
+	var (
+		configFile       string
+		endpoint         string
+		ageIdentityFiles []string
+	)
+
+	flags := flag.NewFlagSet("flux-recv replay-dead-letters", flag.ExitOnError)
+	flags.StringVar(&configFile, "config", "fluxrecv.yaml", "path to config file for flux-recv")
+	flags.StringVar(&endpoint, "endpoint", "", "the name of the endpoint whose dead letters to replay; if not given, those of all endpoints are")
+	flags.StringSliceVar(&ageIdentityFiles, "age-identity", nil, "path to a file of age identities with which to decrypt the config and key files, if they are encrypted")
+
+	bail := func(msg string) {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+
+	flags.Parse(args)
+
+	if err := loadAgeIdentities(ageIdentityFiles); err != nil {
+		bail(err.Error())
+	}
+	config, err := ConfigFromFile(configFile)
+	if err != nil {
+		bail(err.Error())
+	}
+	if err := replayDeadLetters(os.Stdout, filepath.Dir(configFile), config, endpoint); err != nil {
+		bail(err.Error())
+	}
+}
+
+// replayDeadLetters replays the messages in the dead-letter files of
+// the endpoints (or of the one named), and writes a table of the
+// results.
+func replayDeadLetters(out io.Writer, baseDir string, config Config, name string) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tMESSAGE\tRESULT")
+	found := false
+	for _, ep := range config.Endpoints {
+		if ep.DeadLetter == nil || ep.DeadLetter.Path == "" || (name != "" && ep.Name != name) {
+			continue
+		}
+		found = true
+		if err := replayEndpoint(w, baseDir, config.API, ep); err != nil {
+			return fmt.Errorf("endpoint for %s: %s", ep.Source, err.Error())
+		}
+	}
+	if !found {
+		if name != "" {
+			return fmt.Errorf("no endpoint named %q with a dead-letter file", name)
+		}
+		return fmt.Errorf("no endpoints with a dead-letter file")
+	}
+	return w.Flush()
+}
+
+func replayEndpoint(w io.Writer, baseDir string, api Downstream, ep Endpoint) error {
+	path := configPath(baseDir, ep.DeadLetter.Path)
+	records, err := readDeadLetters(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	notifier, err := newFanout(baseDir, ep.downstreams(api))
+	if err != nil {
+		return err
+	}
+
+	label := ep.Name
+	if label == "" {
+		label = ep.Source
+	}
+	var remaining []deadLetterRecord
+	for _, rec := range records {
+		result := "replayed"
+		if err := replayMessage(notifier, rec); err != nil {
+			result = "failed: " + err.Error()
+			remaining = append(remaining, rec)
+		}
+		id := rec.MessageID
+		if id == "" {
+			id = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", label, id, result)
+	}
+
+	// keep anything dead-lettered while replaying
+	now, err := readDeadLetters(path)
+	if err != nil {
+		return err
+	}
+	if len(now) > len(records) {
+		remaining = append(remaining, now[len(records):]...)
+	}
+	return writeDeadLetters(path, remaining)
+}
+
+func replayMessage(s Notifier, rec deadLetterRecord) error {
+	var p payload
+	if err := json.NewDecoder(bytes.NewReader(rec.Body)).Decode(&p); err != nil {
+		return fmt.Errorf("cannot decode payload: %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return passOnGCRMessage(ctx, s, p)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// The webhook sources show the responses they got in their record of
+// deliveries, so a response can say what was done with the request:
+// which event it was, the changes passed on and what came of them, and
+// anything ignored, and why. Clients that ask for JSON (in Accept) get
+// all that; others get the plain text they always did.
+
+// deliveryResponse is the JSON response to a delivery.
+type deliveryResponse struct {
+	Endpoint string          `json:"endpoint,omitempty"`
+	Source   string          `json:"source,omitempty"`
+	Event    string          `json:"event,omitempty"`
+	DryRun   bool            `json:"dryRun,omitempty"`
+	Changes  []changeOutcome `json:"changes"`
+	Skipped  []skippedChange `json:"skipped,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// skippedChange is something in a request that wasn't passed on.
+type skippedChange struct {
+	What   string `json:"what,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// acceptsJSON says whether the client asked for a JSON response. A
+// request without an Accept header gets plain text, as it always did.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header["Accept"] {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err != nil {
+				continue
+			}
+			switch mediaType {
+			case "application/json", "application/*", "*/*":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setEvent records the kind of event the request is for.
+func setEvent(ctx context.Context, event string) {
+	if d := deliveryFrom(ctx); d != nil && event != "" {
+		d.mu.Lock()
+		d.Event = event
+		d.mu.Unlock()
+	}
+}
+
+// recordSkipped records something in the request that wasn't passed
+// on, and why.
+func recordSkipped(ctx context.Context, what, reason string) {
+	if d := deliveryFrom(ctx); d != nil {
+		d.mu.Lock()
+		d.Skipped = append(d.Skipped, skippedChange{What: what, Reason: reason})
+		d.mu.Unlock()
+	}
+}
+
+// newDeliveryResponse makes the response for the request from its
+// delivery record. If outcomes is nil, the changes are those recorded.
+func newDeliveryResponse(r *http.Request, outcomes []changeOutcome) deliveryResponse {
+	resp := deliveryResponse{Changes: outcomes}
+	d := deliveryFrom(r.Context())
+	if d == nil {
+		if resp.Changes == nil {
+			resp.Changes = []changeOutcome{}
+		}
+		return resp
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	resp.Endpoint = d.Endpoint
+	resp.Source = d.Source
+	resp.Event = d.Event
+	resp.DryRun = d.DryRun
+	resp.Skipped = append(resp.Skipped, d.Skipped...)
+	if resp.Changes == nil {
+		resp.Changes = []changeOutcome{}
+		for _, c := range d.Changes {
+			resp.Changes = append(resp.Changes, c.outcome())
+		}
+	}
+	return resp
+}
+
+// respond answers a request that was dealt with, with the JSON
+// response if the client asked for it (or it's a dry run), and
+// otherwise with the text given.
+func respond(w http.ResponseWriter, r *http.Request, status int, text string) {
+	if !acceptsJSON(r) && !isDryRun(r) {
+		w.WriteHeader(status)
+		if text != "" {
+			fmt.Fprint(w, text)
+		}
+		return
+	}
+	resp := newDeliveryResponse(r, nil)
+	writeDeliveryResponse(w, status, resp)
+}
+
+func writeDeliveryResponse(w http.ResponseWriter, status int, resp deliveryResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsJSON(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"":                               false,
+		"text/plain":                     false,
+		"application/json":               true,
+		"text/html, application/*;q=0.9": true,
+		"*/*":                            true,
+	} {
+		req := httptest.NewRequest("POST", "/hook/foo", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		assert.Equal(t, expected, acceptsJSON(req), accept)
+	}
+}
+
+func TestDeliveryResponse(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedGithub, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Name: "config-repo", Source: GitHub, KeyPath: "github_key"}
+	_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
+	assert.NoError(t, err)
+
+	payload := loadFixture(t, "github_payload")
+	post := func(event, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", event)
+		req.Header.Set("X-Hub-Signature", xHubSignature(payload, loadFixture(t, "github_key")))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// without asking for JSON, it's as it always was
+	rec := post("push", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "OK", rec.Body.String())
+
+	rec = post("push", "application/json")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var resp deliveryResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "config-repo", resp.Endpoint)
+	assert.Equal(t, GitHub, resp.Source)
+	assert.Equal(t, "push", resp.Event)
+	if assert.Len(t, resp.Changes, 1) {
+		assert.Equal(t, "refs/tags/simple-tag", resp.Changes[0].Ref)
+		assert.Equal(t, resultOK, resp.Changes[0].Result)
+	}
+
+	// an event that isn't acted on says so
+	rec = post("watch", "*/*")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	resp = deliveryResponse{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "watch", resp.Event)
+	assert.Empty(t, resp.Changes)
+	if assert.Len(t, resp.Skipped, 1) {
+		assert.Equal(t, "not a push event", resp.Skipped[0].Reason)
+	}
+}
+
+// The image sources that say which event it is record it; and those
+// that refuse other events say why.
+func TestImageSourceEvents(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedHarbor, &called)
+	defer downstream.Close()
+
+	post := func(endpoint Endpoint, payload []byte, header map[string]string) deliveryResponse {
+		_, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
+		assert.NoError(t, err)
+		req := httptest.NewRequest("POST", "/hook/foo", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var resp deliveryResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+
+	harbor := Endpoint{Source: Harbor, KeyPath: "harbor_key"}
+	auth := map[string]string{"Authorization": string(loadFixture(t, "harbor_key"))}
+	payload := loadFixture(t, "harbor_payload")
+	resp := post(harbor, payload, auth)
+	assert.Equal(t, "pushImage", resp.Event)
+	assert.Len(t, resp.Changes, 1)
+	resp = post(harbor, bytes.Replace(payload, []byte(`"pushImage"`), []byte(`"deleteImage"`), 1), auth)
+	assert.Equal(t, "deleteImage", resp.Event)
+	if assert.Len(t, resp.Skipped, 1) {
+		assert.Equal(t, "demo.goharbor.io/test123/alpine:3.10", resp.Skipped[0].What)
+	}
+
+	nexus := Endpoint{Source: Nexus, KeyPath: "nexus_key"}
+	payload = bytes.Replace(loadFixture(t, "nexus_payload"), []byte(`"CREATED"`), []byte(`"DELETED"`), 1)
+	mac := hmac.New(sha1.New, loadFixture(t, "nexus_key"))
+	mac.Write(payload)
+	resp = post(nexus, payload, map[string]string{
+		"X-Nexus-Webhook-Id":        "rm:repository:component",
+		"X-Nexus-Webhook-Signature": hex.EncodeToString(mac.Sum(nil)),
+	})
+	assert.Equal(t, "DELETED", resp.Event)
+	if assert.Len(t, resp.Skipped, 1) {
+		assert.Equal(t, "app1/alpine", resp.Skipped[0].What)
+		assert.NotEmpty(t, resp.Skipped[0].Reason)
+	}
+}
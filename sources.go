@@ -2,22 +2,16 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
-	"path/filepath"
 	"time"
 
-	fluxapi "github.com/fluxcd/flux/pkg/api"
 	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
-	fluxhttp "github.com/fluxcd/flux/pkg/http"
-	fluxclient "github.com/fluxcd/flux/pkg/http/client"
 	"github.com/fluxcd/flux/pkg/image"
 )
 
-type HookHandler func(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Request, config Endpoint)
+type HookHandler func(s Notifier, key []byte, w http.ResponseWriter, r *http.Request, config Endpoint)
 
 var Sources = map[string]HookHandler{}
 
@@ -31,7 +25,96 @@ func log(msg ...interface{}) {
 
 // --
 
-func HandlerFromEndpoint(baseDir, apiUrl string, ep Endpoint) (string, http.Handler, error) {
+// HandlerOption supplies HandlerFromEndpoint with something shared by
+// all endpoints.
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	masterKey []byte
+	failures  *failureTracker
+	audit     *auditLog
+	queue     *queue
+	readiness *readiness
+	dryRun    bool
+	rateLimit *rateLimiter
+}
+
+// WithMasterKey gives the master key from which to derive the keys of
+// endpoints that don't have their own.
+func WithMasterKey(key []byte) HandlerOption {
+	return func(o *handlerOptions) {
+		o.masterKey = key
+	}
+}
+
+// WithFailureTracker has requests that fail verification counted, and
+// clients with too many failures banned.
+func WithFailureTracker(t *failureTracker) HandlerOption {
+	return func(o *handlerOptions) {
+		o.failures = t
+	}
+}
+
+// WithAuditLog has a record of each delivery written to the audit log.
+func WithAuditLog(a *auditLog) HandlerOption {
+	return func(o *handlerOptions) {
+		o.audit = a
+	}
+}
+
+// WithQueue gives the queue for async endpoints.
+func WithQueue(q *queue) HandlerOption {
+	return func(o *handlerOptions) {
+		o.queue = q
+	}
+}
+
+// WithReadiness has the endpoint's downstreams checked by /ready.
+func WithReadiness(rd *readiness) HandlerOption {
+	return func(o *handlerOptions) {
+		o.readiness = rd
+	}
+}
+
+// WithRateLimit applies a rate limit shared by all endpoints, as well
+// as any the endpoint has of its own.
+func WithRateLimit(l *rateLimiter) HandlerOption {
+	return func(o *handlerOptions) {
+		o.rateLimit = l
+	}
+}
+
+// WithDryRun has every endpoint do a dry run, as though it had
+// `dryRun: true`.
+func WithDryRun() HandlerOption {
+	return func(o *handlerOptions) {
+		o.dryRun = true
+	}
+}
+
+// downstreams are those the endpoint's changes go to: its own, if it
+// has any, or else the API.
+func (ep Endpoint) downstreams(api Downstream) []Downstream {
+	if len(ep.Downstreams) > 0 {
+		return ep.Downstreams
+	}
+	return []Downstream{api}
+}
+
+// label names the endpoint in logs and metrics.
+func (ep Endpoint) label(digest string) string {
+	if ep.Name != "" {
+		return ep.Name
+	}
+	return fmt.Sprintf("%s endpoint %.7s", ep.Source, digest)
+}
+
+func HandlerFromEndpoint(baseDir string, api Downstream, ep Endpoint, opts ...HandlerOption) (string, http.Handler, error) {
+	var options handlerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	// 1. find the relevant Source (e.g., DockerHub)
 	sourceHandler, ok := Sources[ep.Source]
 	if !ok {
@@ -40,25 +123,130 @@ func HandlerFromEndpoint(baseDir, apiUrl string, ep Endpoint) (string, http.Hand
 
 	// 2. load the key so it can be used in the handler, and get the
 	// digest so it can be used to route to this handler
-	key, err := ioutil.ReadFile(filepath.Join(baseDir, ep.KeyPath))
+	key, err := endpointKey(baseDir, ep, options.masterKey)
 	if err != nil {
-		return "", nil, fmt.Errorf("cannot load key from %q: %s", ep.KeyPath, err.Error())
+		return "", nil, fmt.Errorf("endpoint for %s: %s", ep.Source, err.Error())
+	}
+	digest := endpointDigest(key, ep)
+	dryRun := ep.DryRun || options.dryRun
+
+	var next Notifier = skipNotifier{}
+	if ep.ForwardOnly {
+		if len(ep.Forward) == 0 {
+			return "", nil, fmt.Errorf("endpoint for %s: forwardOnly, but nowhere to forward to", ep.Source)
+		}
+	} else if dryRun {
+		// the downstreams are still checked, so that the
+		// configuration is too; but nothing is connected to, or
+		// opened
+		if err := checkDownstreams(ep.downstreams(api)); err != nil {
+			return "", nil, fmt.Errorf("endpoint for %s: %s", ep.Source, err.Error())
+		}
+		next = dryRunNotifier{endpoint: ep.label(digest)}
+	} else {
+		apiClients, err := newFanout(baseDir, ep.downstreams(api))
+		if err != nil {
+			return "", nil, fmt.Errorf("endpoint for %s: %s", ep.Source, err.Error())
+		}
+		if options.readiness != nil {
+			for _, t := range apiClients {
+				options.readiness.add(t)
+			}
+		}
+		if ep.Async {
+			if options.queue == nil {
+				return "", nil, fmt.Errorf("endpoint for %s: async, but there is no queue", ep.Source)
+			}
+			for i := range apiClients {
+				apiClients[i].notifier = options.queue.notifier(ep.label(digest)+" -> "+apiClients[i].name, apiClients[i].notifier)
+			}
+		}
+		next = apiClients
+	}
+
+	// 3. construct a handler from the above; changes passed to the API
+	// are recorded in the delivery (after rewriting any git URL), and
+	// requests handled successfully forwarded
+	if ep.Debounce > 0 && !dryRun {
+		next = newDebouncer(ep.label(digest), time.Duration(ep.Debounce), next)
+	}
+	var notifier Notifier = recordingNotifier{next: next}
+	if ep.GitURL != nil {
+		if notifier, err = newGitURLRewriter(*ep.GitURL, notifier); err != nil {
+			return "", nil, fmt.Errorf("endpoint for %s: %s", ep.Source, err.Error())
+		}
+	}
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sourceHandler(notifier, key, w, r, ep)
+	})
+	if len(ep.Forward) > 0 {
+		forwarder, err := newForwarder(baseDir, ep.label(digest), ep.Forward)
+		if err != nil {
+			return "", nil, fmt.Errorf("endpoint for %s: %s", ep.Source, err.Error())
+		}
+		if !dryRun {
+			handler = forwarder.wrap(handler)
+		}
+	}
+	if dryRun {
+		handler = markDryRun(handler)
+	}
+	// messages that can't be acted on are kept, and listed on GET,
+	// behind the same restrictions as the hook
+	if ep.DeadLetter != nil {
+		if ep.Source != GoogleContainerRegistry {
+			return "", nil, fmt.Errorf("endpoint for %s: deadLetter is only for %s", ep.Source, GoogleContainerRegistry)
+		}
+		dl, err := openDeadLetters(baseDir, *ep.DeadLetter)
+		if err != nil {
+			return "", nil, fmt.Errorf("endpoint for %s: %s", ep.Source, err.Error())
+		}
+		handler = dl.list(ep, withDeadLetters(dl, handler))
+	}
+	handler = reached(handler)
+	if options.failures != nil {
+		handler = options.failures.wrap(ep.label(digest), handler)
+	}
+
+	// 4. add any restrictions on who can call it, and how often
+	if ep.RateLimit != nil {
+		limiter, err := newRateLimiter(ep.label(digest), *ep.RateLimit)
+		if err != nil {
+			return "", nil, err
+		}
+		handler = limiter.wrap(handler)
+	}
+	if ep.ClientCAPath != "" {
+		if handler, err = requireClientCert(baseDir, ep, handler); err != nil {
+			return "", nil, fmt.Errorf("endpoint for %s: %s", ep.Source, err.Error())
+		}
+	}
+	if ep.AllowedIPs != nil {
+		allowList, err := newIPAllowList(baseDir, *ep.AllowedIPs)
+		if err != nil {
+			return "", nil, fmt.Errorf("endpoint for %s: %s", ep.Source, err.Error())
+		}
+		handler = allowList.wrap(ep.Source, handler)
 	}
 
-	sha := sha256.New()
-	sha.Write(key)
-	sha.Write([]byte(ep.RegistryHost))
-	digest := fmt.Sprintf("%x", sha.Sum(nil))
+	// 5. check it looks like a webhook before doing anything else,
+	// other than applying the rate limit for all endpoints
+	handler = guardRequest(ep, handler)
+	if options.rateLimit != nil {
+		handler = options.rateLimit.wrap(handler)
+	}
 
-	apiClient := fluxclient.New(http.DefaultClient, fluxhttp.NewAPIRouter(), apiUrl, fluxclient.Token(""))
+	// 6. keep a record of every request
+	// (a dry run isn't queued, so it can say what it would have done)
+	if ep.Async && !dryRun {
+		handler = acceptQueued(handler)
+	}
+	handler = trackDelivery(ep.label(digest), ep.Source, ep.maxBodyBytes(), options.audit, handler)
 
-	// 3. construct a handler from the above
-	return digest, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sourceHandler(apiClient, key, w, r, ep)
-	}), nil
+	return digest, handler, nil
 }
 
-func doImageNotify(s fluxapi.Server, w http.ResponseWriter, r *http.Request, img string) {
+func doImageNotify(s Notifier, w http.ResponseWriter, r *http.Request, source, img string) {
 	ref, err := image.ParseRef(img)
 	if err != nil {
 		http.Error(w, "Cannot parse image in webhook payload", http.StatusBadRequest)
@@ -74,6 +262,9 @@ func doImageNotify(s fluxapi.Server, w http.ResponseWriter, r *http.Request, img
 	ctx := r.Context()
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	s.NotifyChange(ctx, change)
-	w.WriteHeader(http.StatusOK)
+	if err := s.NotifyChange(ctx, change); err != nil {
+		notifyFailed(w, r, source, err)
+		return
+	}
+	respond(w, r, http.StatusOK, "")
 }
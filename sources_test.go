@@ -2,16 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -48,7 +58,7 @@ func Test_DockerHubSource(t *testing.T) {
 	defer downstream.Close()
 
 	endpoint := Endpoint{Source: DockerHub, KeyPath: "dockerhub_key"}
-	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
 
 	hookServer := httptest.NewTLSServer(handler)
@@ -57,6 +67,7 @@ func Test_DockerHubSource(t *testing.T) {
 	c := hookServer.Client()
 	req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "dockerhub_payload")))
 	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
 
 	res, err := c.Do(req)
 	assert.NoError(t, err)
@@ -72,7 +83,7 @@ func Test_Quay(t *testing.T) {
 	defer downstream.Close()
 
 	endpoint := Endpoint{Source: Quay, KeyPath: "quay_key"}
-	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
 
 	hookServer := httptest.NewTLSServer(handler)
@@ -81,6 +92,7 @@ func Test_Quay(t *testing.T) {
 	c := hookServer.Client()
 	req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "quay_payload")))
 	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
 
 	res, err := c.Do(req)
 	assert.NoError(t, err)
@@ -103,7 +115,7 @@ func Test_GitHubSource(t *testing.T) {
 	//     ruby -rsecurerandom -e 'puts SecureRandom.hex(20)' > test/fixtures/github_key
 	// as suggested in the GitHub docs.
 	endpoint := Endpoint{Source: GitHub, KeyPath: "github_key"}
-	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
 
 	hookServer := httptest.NewTLSServer(handler)
@@ -173,7 +185,7 @@ func Test_GitLabSource(t *testing.T) {
 	defer downstream.Close()
 
 	endpoint := Endpoint{Source: GitLab, KeyPath: "gitlab_key"}
-	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
 
 	hookServer := httptest.NewTLSServer(handler)
@@ -214,7 +226,7 @@ func Test_Harbor(t *testing.T) {
 	defer downstream.Close()
 
 	endpoint := Endpoint{Source: Harbor, KeyPath: "harbor_key"}
-	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
 
 	hookServer := httptest.NewTLSServer(handler)
@@ -225,6 +237,7 @@ func Test_Harbor(t *testing.T) {
 	c := hookServer.Client()
 	req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
 	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", string(loadFixture(t, "harbor_key")))
 
 	res, err := c.Do(req)
@@ -236,6 +249,7 @@ func Test_Harbor(t *testing.T) {
 	called = false
 	req, err = http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
 	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "BOGUS")
 	res, err = c.Do(req)
 	assert.NoError(t, err)
@@ -251,7 +265,7 @@ func Test_HarborV2(t *testing.T) {
 	defer downstream.Close()
 
 	endpoint := Endpoint{Source: Harbor, KeyPath: "harborV2_key"}
-	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
 
 	hookServer := httptest.NewTLSServer(handler)
@@ -262,6 +276,7 @@ func Test_HarborV2(t *testing.T) {
 	c := hookServer.Client()
 	req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
 	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", string(loadFixture(t, "harborV2_key")))
 
 	res, err := c.Do(req)
@@ -273,6 +288,7 @@ func Test_HarborV2(t *testing.T) {
 	called = false
 	req, err = http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
 	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "BOGUS")
 	res, err = c.Do(req)
 	assert.NoError(t, err)
@@ -288,7 +304,7 @@ func Test_Nexus(t *testing.T) {
 	defer downstream.Close()
 
 	endpoint := Endpoint{Source: Nexus, KeyPath: "nexus_key", RegistryHost: "container.example.com"}
-	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
 
 	hookServer := httptest.NewTLSServer(handler)
@@ -299,6 +315,7 @@ func Test_Nexus(t *testing.T) {
 	c := hookServer.Client()
 	req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
 	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Nexus-Webhook-Id", "rm:repository:component")
 	req.Header.Set("X-Nexus-Webhook-Delivery", "bd9e6aef-0e27-4570-980d-f639c49ab5ed")
 	req.Header.Set("X-Nexus-Webhook-Signature", "d06eea380d4631e8c1180b689d10d9ba83ab68f6")
@@ -312,6 +329,7 @@ func Test_Nexus(t *testing.T) {
 	called = false
 	req, err = http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
 	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Nexus-Webhook-Id", "rm:repository:component")
 	req.Header.Set("X-Nexus-Webhook-Delivery", "bd9e6aef-0e27-4570-980d-f639c49ab5ed")
 	req.Header.Set("X-Nexus-Webhook-Signature", "BOGUS")
@@ -329,7 +347,7 @@ func Test_BitbucketCloud(t *testing.T) {
 	defer downstream.Close()
 
 	endpoint := Endpoint{Source: BitbucketCloud, KeyPath: "bitbucket_cloud_key"}
-	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
 
 	hookServer := httptest.NewTLSServer(handler)
@@ -368,7 +386,7 @@ func Test_BitbucketServer(t *testing.T) {
 	defer downstream.Close()
 
 	endpoint := Endpoint{Source: BitbucketServer, KeyPath: "bitbucket_server_key"}
-	digest, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	digest, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
 
 	hookServer := httptest.NewTLSServer(handler)
@@ -436,7 +454,7 @@ func Test_GoogleContainerRegistry_WhenNoAuth(t *testing.T) {
 	defer downstream.Close()
 
 	endpoint := Endpoint{Source: GoogleContainerRegistry, KeyPath: "gcr_key", GCR: nil}
-	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
 
 	hookServer := httptest.NewTLSServer(handler)
@@ -445,6 +463,7 @@ func Test_GoogleContainerRegistry_WhenNoAuth(t *testing.T) {
 	c := hookServer.Client()
 	req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "gcr_payload")))
 	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
 
 	res, err := c.Do(req)
 	assert.NoError(t, err)
@@ -453,25 +472,252 @@ func Test_GoogleContainerRegistry_WhenNoAuth(t *testing.T) {
 	assert.Empty(t, res.Body)
 }
 
-type roundTripFunc func(r *http.Request) (*http.Response, error)
+// helper to serve a JWKS containing the public half of key, and to
+// sign tokens with it
+type testSigner struct {
+	key  *rsa.PrivateKey
+	kid  string
+	jwks *httptest.Server
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	s := &testSigner{key: key, kid: "test-key"}
+	s.jwks = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": s.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	return s
+}
 
-func (s roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
-	return s(r)
+func (s *testSigner) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": s.kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	hashed := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hashed[:])
+	assert.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
 }
 
 func Test_GoogleContainerRegistry_WhenAuth(t *testing.T) {
-	c := &http.Client{
-		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
-			return &http.Response{
-				StatusCode: 200,
-				Body:       ioutil.NopCloser(bytes.NewBuffer(loadFixture(t, "gcr_auth_result"))),
-			}, nil
-		}),
+	signer := newTestSigner(t)
+	defer signer.jwks.Close()
+
+	var called bool
+	downstream := newDownstream(t, expectedGoogleContainerRegistry, &called)
+	defer downstream.Close()
+
+	auth := &GCRAuth{
+		Audience: "gcr-update",
+		Email:    "pusher@example.iam.gserviceaccount.com",
+		JWKSURL:  signer.jwks.URL,
+	}
+	endpoint := Endpoint{Source: GoogleContainerRegistry, KeyPath: "gcr_key", GCR: auth}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
+	assert.NoError(t, err)
+
+	hookServer := httptest.NewTLSServer(handler)
+	defer hookServer.Close()
+
+	goodClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            "gcr-update",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"email":          "pusher@example.iam.gserviceaccount.com",
+			"email_verified": true,
+		}
+	}
+
+	for _, tt := range []struct {
+		desc     string
+		token    func() string
+		status   int
+		notified bool
+	}{
+		{
+			desc:     "ok",
+			token:    func() string { return signer.sign(t, goodClaims()) },
+			status:   http.StatusOK,
+			notified: true,
+		},
+		{
+			desc:   "missing token",
+			token:  func() string { return "" },
+			status: http.StatusUnauthorized,
+		},
+		{
+			desc: "wrong audience",
+			token: func() string {
+				c := goodClaims()
+				c["aud"] = "someone-else"
+				return signer.sign(t, c)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			desc: "wrong issuer",
+			token: func() string {
+				c := goodClaims()
+				c["iss"] = "https://example.com"
+				return signer.sign(t, c)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			desc: "expired",
+			token: func() string {
+				c := goodClaims()
+				c["exp"] = time.Now().Add(-time.Hour).Unix()
+				return signer.sign(t, c)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			desc: "other service account",
+			token: func() string {
+				c := goodClaims()
+				c["email"] = "mallory@example.iam.gserviceaccount.com"
+				return signer.sign(t, c)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			desc: "bad signature",
+			token: func() string {
+				token := signer.sign(t, goodClaims())
+				return token[:len(token)-4] + "AAAA"
+			},
+			status: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "gcr_payload")))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if token := tt.token(); token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			called = false
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, res.StatusCode)
+			assert.Equal(t, tt.notified, called)
+		})
 	}
+}
 
-	token := "Bearer 123"
-	audience := "gcr-update"
+// Fetching the signing keys doesn't hold up requests with keys already
+// cached, and requests for a key that isn't wait on the one fetch.
+func Test_GoogleContainerRegistry_KeySetFetch(t *testing.T) {
+	signer := newTestSigner(t)
+	defer signer.jwks.Close()
+	var mu sync.Mutex
+	var fetches int
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		n := fetches
+		mu.Unlock()
+		if n > 1 {
+			<-release
+		}
+		signer.jwks.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	ks := &keySet{url: server.URL}
+	_, err := ks.key(context.Background(), signer.kid)
+	assert.NoError(t, err)
+
+	// an unknown key prompts a fetch (once the last one is long
+	// enough ago), which is held up
+	ks.mu.Lock()
+	ks.lastFetch = time.Now().Add(-minJWKSRefetch)
+	ks.mu.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ks.key(context.Background(), "rotated-in")
+			assert.Error(t, err)
+		}()
+	}
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches == 2
+	})
+
+	// meanwhile, the cached key is still there
+	got := make(chan error)
+	go func() {
+		_, err := ks.key(context.Background(), signer.kid)
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Error("cached key waited for fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	mu.Lock()
+	assert.Equal(t, 2, fetches)
+	mu.Unlock()
+}
 
-	err := authenticateRequest(c, token, audience)
+// Test that requests which can't be webhooks are turned away before
+// they reach the source handler.
+func Test_RequestChecks(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedDockerhub, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: DockerHub, KeyPath: "dockerhub_key", MaxBodyBytes: 64}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", Downstream{URL: downstream.URL}, endpoint)
 	assert.NoError(t, err)
+
+	hookServer := httptest.NewTLSServer(handler)
+	defer hookServer.Close()
+
+	for _, tt := range []struct {
+		desc        string
+		method      string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"GET", "GET", "application/json", nil, http.StatusMethodNotAllowed},
+		{"no content type", "POST", "", []byte(`{}`), http.StatusUnsupportedMediaType},
+		{"form encoded", "POST", "application/x-www-form-urlencoded", []byte(`{}`), http.StatusUnsupportedMediaType},
+		{"too big", "POST", "application/json; charset=utf-8", loadFixture(t, "dockerhub_payload"), http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, hookServer.URL+"/hook/"+fp, bytes.NewReader(tt.body))
+			assert.NoError(t, err)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			called = false
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, res.StatusCode)
+			assert.False(t, called)
+		})
+	}
 }
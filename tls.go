@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// flux-recv can terminate TLS itself, for when there's nothing in
+// front of it to do so. The certificate is usually mounted from a
+// secret, which may be rotated (e.g., by cert-manager); so, the files
+// are checked periodically, and the certificate reloaded if they've
+// changed.
+
+const certReloadInterval = 30 * time.Second
+
+type certReloader struct {
+	certPath, keyPath string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the certificate and key, and if either has changed,
+// replaces the certificate being served. It reports whether the
+// certificate was replaced.
+func (c *certReloader) reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(c.certPath)
+	if err != nil {
+		return false, fmt.Errorf("cannot read TLS certificate: %s", err.Error())
+	}
+	keyPEM, err := ioutil.ReadFile(c.keyPath)
+	if err != nil {
+		return false, fmt.Errorf("cannot read TLS key: %s", err.Error())
+	}
+
+	c.mu.RLock()
+	unchanged := bytes.Equal(certPEM, c.certPEM) && bytes.Equal(keyPEM, c.keyPEM)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	// The certificate and key are usually updated together, but not
+	// atomically; if they don't match, it'll be tried again later.
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("cannot load TLS certificate: %s", err.Error())
+	}
+
+	c.mu.Lock()
+	c.cert, c.certPEM, c.keyPEM = &cert, certPEM, keyPEM
+	c.mu.Unlock()
+	return true, nil
+}
+
+func (c *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := c.reload()
+		switch {
+		case err != nil:
+			log("TLS certificate not reloaded:", err.Error())
+		case reloaded:
+			log("reloaded TLS certificate from", c.certPath)
+		}
+	}
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// serverTLSConfig makes the TLS config for serving with the
+// certificate and key given. If requestClientCerts is true, clients
+// are asked for a certificate; it's up to each endpoint whether it
+// requires one, and which CA it must be signed by.
+func serverTLSConfig(certs *certReloader, requestClientCerts bool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if requestClientCerts {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return config
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+	return pool, nil
+}
+
+// requireClientCert wraps a handler so that it only accepts requests
+// with a client certificate signed by one of the CAs given.
+func requireClientCert(baseDir string, ep Endpoint, next http.Handler) (http.Handler, error) {
+	roots, err := loadCertPool(filepath.Join(baseDir, ep.ClientCAPath))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load client CA: %s", err.Error())
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "A client certificate is required", http.StatusUnauthorized)
+			log(ep.Source, "no client certificate presented")
+			return
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := r.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			http.Error(w, "The client certificate is not trusted", http.StatusUnauthorized)
+			log(ep.Source, "untrusted client certificate:", err.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// makeCert creates a certificate signed by parent, or self-signed if
+// parent is nil.
+func makeCert(t *testing.T, name string, parent *testCert, isCA bool, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	assert.NoError(t, err)
+	return cert
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	first := makeCert(t, "first.example.com", nil, false, x509.ExtKeyUsageServerAuth)
+	assert.NoError(t, ioutil.WriteFile(certPath, first.certPEM, 0600))
+	assert.NoError(t, ioutil.WriteFile(keyPath, first.keyPEM, 0600))
+
+	certs, err := newCertReloader(certPath, keyPath)
+	assert.NoError(t, err)
+	served, _ := certs.GetCertificate(nil)
+	assert.Equal(t, first.cert.Raw, served.Certificate[0])
+
+	reloaded, err := certs.reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	// a half-done rotation is not fatal, and leaves the old certificate
+	second := makeCert(t, "second.example.com", nil, false, x509.ExtKeyUsageServerAuth)
+	assert.NoError(t, ioutil.WriteFile(certPath, second.certPEM, 0600))
+	_, err = certs.reload()
+	assert.Error(t, err)
+	served, _ = certs.GetCertificate(nil)
+	assert.Equal(t, first.cert.Raw, served.Certificate[0])
+
+	assert.NoError(t, ioutil.WriteFile(keyPath, second.keyPEM, 0600))
+	reloaded, err = certs.reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	served, _ = certs.GetCertificate(nil)
+	assert.Equal(t, second.cert.Raw, served.Certificate[0])
+}
+
+func Test_ClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := makeCert(t, "Test CA", nil, true, x509.ExtKeyUsageClientAuth)
+	otherCA := makeCert(t, "Other CA", nil, true, x509.ExtKeyUsageClientAuth)
+	client := makeCert(t, "bitbucket.example.com", ca, false, x509.ExtKeyUsageClientAuth)
+	impostor := makeCert(t, "bitbucket.example.com", otherCA, false, x509.ExtKeyUsageClientAuth)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca.certPEM, 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dockerhub_key"), loadFixture(t, "dockerhub_key"), 0600))
+
+	var called bool
+	downstream := newDownstream(t, expectedDockerhub, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: DockerHub, KeyPath: "dockerhub_key", ClientCAPath: "ca.crt"}
+	fp, handler, err := HandlerFromEndpoint(dir, Downstream{URL: downstream.URL}, endpoint)
+	assert.NoError(t, err)
+
+	hookServer := httptest.NewUnstartedServer(handler)
+	hookServer.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	hookServer.StartTLS()
+	defer hookServer.Close()
+
+	for _, tt := range []struct {
+		desc   string
+		cert   *testCert
+		status int
+	}{
+		{"trusted", client, http.StatusOK},
+		{"no certificate", nil, http.StatusUnauthorized},
+		{"other CA", impostor, http.StatusUnauthorized},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			transport := hookServer.Client().Transport.(*http.Transport).Clone()
+			// make sure each case gets its own handshake
+			transport.DisableKeepAlives = true
+			transport.TLSClientConfig.ClientSessionCache = nil
+			if tt.cert != nil {
+				transport.TLSClientConfig.Certificates = []tls.Certificate{tt.cert.tlsCertificate(t)}
+			}
+			c := &http.Client{Transport: transport}
+
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "dockerhub_payload")))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+
+			called = false
+			res, err := c.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, res.StatusCode)
+			assert.Equal(t, tt.status == http.StatusOK, called)
+		})
+	}
+}